@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
 )
 
@@ -44,3 +45,31 @@ func TestDirentCount(t *testing.T) {
 		t.Fatalf("direntCount: on second call, got %d; want %d", got, want)
 	}
 }
+
+func BenchmarkDirentCount(b *testing.B) {
+	dir := b.TempDir()
+	for i := 0; i < 500; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(i)), nil, 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	run := func(b *testing.B, reuse bool) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			f, err := os.Open(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !reuse {
+				buf = nil
+			}
+			if _, buf, err = direntCount(f, buf); err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+		}
+	}
+	b.Run("fresh", func(b *testing.B) { run(b, false) })
+	b.Run("reused", func(b *testing.B) { run(b, true) })
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -12,36 +13,86 @@ import (
 	"math/bits"
 	"os"
 	"os/user"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/template"
 	"time"
-	"unsafe"
+	"unicode/utf8"
 
 	"github.com/cespare/tabular"
 	"github.com/dustin/go-humanize"
 	"golang.org/x/sys/unix"
 )
 
-// #include <unistd.h>
-import "C"
-
 func main() {
 	log.SetFlags(0)
 	var (
-		all      = flag.Bool("all", false, "List processes from all users, not just the current user")
-		full     = flag.Bool("full", false, "Shorthand for -cols 'pid,ppid,user,cmdline'")
-		colsFlag = flag.String("cols", "", "List of columns to display (comma-separated)")
-		only     = flag.String("only", "", "Display this single column alone (and no header)")
+		all        = flag.Bool("all", false, "List processes from all users, not just the current user")
+		self       = flag.Bool("self", false, "Include the lp process itself (implied by -all)")
+		full       = flag.Bool("full", false, "Shorthand for -cols 'pid,ppid,user,cmdline'")
+		xfull      = flag.Bool("xfull", false, "Shorthand for -cols 'pid,ppid,user,state,rss,cputime,nthreads,cmdline'")
+		colsFlag   = flag.String("cols", "", "List of columns to display (comma-separated)")
+		colsExcept = flag.String("cols-except", "", "Display every available column except these (comma-separated)")
+		colsFile   = flag.String("fields-from-file", "", "Read the list of columns to display (separated by commas or newlines) from `FILE`")
+		only       = flag.String("only", "", "Display this single column alone (and no header)")
+		total      = flag.Bool("total", false, "Append a footer row with totals of numeric columns such as rss (not with -threads)")
+		byUser     = flag.Bool("by-user", false, "Instead of listing processes, summarize process count, rss, and cputime per user")
+		states     = flag.Bool("count-states", false, "Instead of listing processes, print the number of processes in each state")
+		procRoot   = flag.String("proc-root", "/proc", "Read process information from this procfs mount (Linux only)")
+		threads    = flag.Bool("threads", false, "List each thread as a separate row (pid shows the thread ID; -pid selects all threads of a process)")
+		dot        = flag.Bool("dot", false, "Instead of a table, print the process hierarchy in Graphviz DOT format")
+		color      = flag.String("color", "never", "Colorize rows (zombies, CPU hogs, and your own processes): auto (if stdout is a terminal), always, or never")
+		wide       = flag.Bool("wide", false, "Don't trim lines to the terminal width")
+		maxWidth   = flag.Int("max-col-width", 0, "Truncate the contents of each column to at most `N` characters (with ... at the end)")
+		cmdWidth   = flag.Int("cmd-width", 0, "Truncate the cmdline column to at most `N` characters (with ... at the end)")
+		width      = flag.Int("width", 0, "Trim lines to this many columns, as if writing to a terminal of this width (default: the terminal width, if stdout is a terminal)")
+		units      = flag.Bool("units", false, "Add units to the headers of columns printed as plain numbers (such as rss(bytes) with -tsv)")
+		tsv        = flag.Bool("tsv", false, "Write tab-separated values in raw units (bytes and seconds) instead of a table")
+		sep        = flag.String("sep", defaultSep, "Separate columns with this string (which may use Go escapes such as \\t)")
+		cpuTotal   = flag.Bool("cpu-total", false, "Scale pcpu so that 100% means all CPUs are busy (by default, 100% means one CPU is busy)")
+		newest     = flag.Int("newest", 0, "Only list the `N` most recently started processes, newest first")
+		oldest     = flag.Int("oldest", 0, "Only list the `N` earliest started processes, oldest first")
+		uniq       = flag.String("uniq", "", "Instead of listing processes, print each distinct value of the column `COL` (such as cmdline or base) with a count")
+		count      = flag.Bool("count", false, "Instead of listing processes, print the number of them")
+		memSum     = flag.Bool("mem-summary", false, "Instead of listing processes, print their total rss, pss, and uss (pss and uss count shared memory only once)")
+		format     = flag.String("format", "", "Instead of a table, print each process using this Go text/template `TEMPLATE` (see below)")
+		boldRSS    = flag.Bool("bold-max-rss", false, "On a terminal, show the row of the process with the largest rss in bold")
+		iec        = flag.Bool("iec", false, "Show sizes in binary units (KiB, MiB, ...) rather than SI units (kB, MB, ...)")
+		ppidTree   = flag.Bool("ppid-tree", false, "List each process selected by -pid (or -stdin) along with its ancestors, indented by generation")
+		summary    = flag.Bool("summary", false, "Print a line with the number of processes, running processes, and zombies and the total rss before the table\n(to stderr, if stdout isn't a terminal)")
+		debug      = flag.Bool("debug", false, "Print how long each step took to stderr")
+		yes        = flag.Bool("yes", false, "Don't ask for confirmation before sending the -kill signal")
 	)
+	var killSig syscall.Signal
+	var durationUnit time.Duration
+	flag.Var(durationUnitFlag{&durationUnit}, "duration-unit", "Print durations as an exact number of this `UNIT` (s, ms, us, or ns) rather than humanized")
+	flag.Var(signalFlag{&killSig}, "kill", "After listing, send the `SIGNAL` (such as TERM, SIGKILL, or 9) to each listed process")
 	var f filter
-	flag.Var(reFlag{&f.name}, "name", "Regular expression to match against process name")
-	flag.Var(reFlag{&f.cmd}, "cmd", "Regular expression to match against the cmdline")
-	flag.IntVar(&f.pid, "pid", 0, "Only list the process with this process ID")
+	namePattern := flag.String("name", "", "Regular expression (or glob, with -glob) to match against process name")
+	cmdPattern := flag.String("cmd", "", "Regular expression (or glob, with -glob) to match against the cmdline")
+	basePattern := flag.String("base", "", "Regular expression (or glob, with -glob) to match against the base column (the basename of arg0)")
+	exePattern := flag.String("exe", "", "Regular expression (or glob, with -glob) to match against the executable path (processes whose executable can't be read are excluded)")
+	glob := flag.Bool("glob", false, "Interpret -name, -cmd, -base, and -exe as shell globs (such as '*.py') that must match the whole string")
+	flag.Var(usersFlag{&f.users}, "user", "Only list the processes belonging to these `USERS` (comma-separated; may be repeated) rather than the current user")
+	numericUID := flag.Bool("numeric-uid", false, "Show numeric UIDs rather than usernames (in user, ruid, euid, and loginuid, and for -user)")
+	flag.Var(pidsFlag{&f.pids}, "pid", "Only list the processes with these process IDs (comma-separated; may be repeated)")
+	fromStdin := flag.Bool("stdin", false, "Only list the processes whose PIDs are read from stdin (one per line), such as the output of pgrep")
 	flag.IntVar(&f.ppid, "ppid", 0, "Only list processes with this parent PID")
 	flag.IntVar(&f.pgid, "pgid", 0, "Only list processes with this process group ID")
+	flag.BoolVar(&f.running, "running", false, "Only list processes that are running or runnable (state R)")
+	flag.Int64Var(&f.minFDs, "min-fds", 0, "Only list processes with more than `N` open file descriptors (excluding those whose fds can't be counted)")
+	flag.IntVar(&f.minThreads, "min-threads", 0, "Only list processes with more than `N` threads")
+	flag.Var(sinceFlag{&f.since}, "since", "Only list processes started after `TIME`: an RFC 3339 timestamp, a time of day today (15:04 or 15:04:05),\nor a duration ago (such as 1h or -1h)")
+	flag.BoolVar(&f.leaders, "leaders", false, "Only list session leaders and process group leaders")
+	flag.BoolVar(&f.any, "any", false, "List processes matching any (rather than all) of the filters such as -name, -pid, and -env")
+	flag.BoolVar(&f.invert, "v", false, "Invert the filters: list the processes that don't match them")
+	flag.Var(envFlag{&f.env}, "env", "Only list processes with the environment variable `KEY=VALUE` (or KEY~REGEX to match the value\nagainst a regular expression); may be repeated. Processes with an unreadable environment are excluded")
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, `lp: list processes
 
@@ -59,24 +110,126 @@ and then each subsequent row corresponds to a process.
 
 By default, lp includes all processes belonging to the current user except for
 the lp process itself. With the -all flag, lp prints all processes for all users,
-including the lp process. Flags such as -pid, -name, and others filter down the
-results using other criteria.
+including the lp process. (The -self flag includes the lp process without
+listing other users' processes.) Flags such as -pid, -name, and others filter down the
+results using other criteria; -user (e.g., -user alice,bob) selects other users'
+processes instead of the current user's.
+
+A process must match all of the filters unless -any is given, in which case
+it must match at least one of them. For example, lp -any -pid 123 -ppid 123
+lists process 123 together with its children. The -v flag inverts the result,
+listing the processes that don't match (like grep -v). Either way, only the
+current user's processes are considered unless -all or -user is given, and lp
+doesn't list itself unless -self or -all is given.
 
 The default set of columns is just pid and process name. A larger set of
-commonly-used columns is enabled by using -full. The set of columns may be
-customized using -cols 'col1,col2,...'. The full set of available columns is:
+commonly-used columns is enabled by using -full, and -xfull adds state, rss,
+cputime, and nthreads to those. The set of columns may be customized using
+-cols 'col1,col2,...', or by removing columns from the set of all of them with
+-cols-except 'col1,col2,...'. The full set of available columns is:
 
 `)
 		printAllColumns()
 		fmt.Fprint(os.Stderr, `
 The -only flag selects a single column for display and suppresses the column header.
 This is useful for piping to other commands (e.g., lp -only pid ... | xargs kill).
+
+The -kill flag sends a signal to every listed process after printing the table
+(e.g., lp -name stuck-worker -kill TERM). lp asks for confirmation first unless
+-yes is given (which is required with -stdin), and it never signals itself
+unless -self is given. -kill can't be used with -proc-root, whose PIDs may
+belong to another PID namespace.
+
+Default display flags may be set in a config file, $XDG_CONFIG_HOME/lp/config
+(usually ~/.config/lp/config). Each line is flagname=value (or just flagname for
+a boolean flag such as -total); blank lines and lines starting with # are
+ignored. Only flags that control the display (the column selection flags,
+-total, -summary, -color, -bold-max-rss, -wide, -width, -max-col-width,
+-cmd-width, -sep, -duration-unit, -iec, -units, -numeric-uid, and -cpu-total)
+are allowed. For example:
+
+  # Always show these columns.
+  cols=pid,user,rss,cmdline
+
+The LP_COLS environment variable, if set, gives the default list of columns in
+the same form as -cols (e.g., LP_COLS=pid,user,rss,cputime,cmdline).
+
+Flags given on the command line take precedence over LP_COLS, which in turn
+takes precedence over the config file. Setting any of -cols, -cols-except,
+-fields-from-file, -full, -xfull, and -only on the command line overrides all of
+them in the config file, and config file flags that can't be used with the
+command-line flags (such as total with -by-user) are ignored.
+
+The -tsv flag writes tab-separated values with a header line instead of a table.
+Sizes are given in bytes and durations in seconds (or in the -duration-unit),
+and tabs and newlines within values (such as cmdline) are replaced by spaces, so
+there is always exactly one line per process. Add -units to put the units in
+the header (such as rss(bytes) and uptime(s)).
+
+The -sep flag changes the string between columns (two spaces by default). With
+a tab separator (-sep '\t'), the columns aren't padded for alignment, so the
+output is tab-separated values that are easy to process with cut or awk.
+
+The -format flag prints each process using a Go text/template
+(https://golang.org/pkg/text/template) followed by a newline. Each column is
+available as a field named after the column with an initial capital letter,
+except that abbreviations are all caps: .PID, .PPID, .User, .RSS, .CPUTime,
+.Cmdline, and so on. Sizes and durations are printed in the same way as in the
+table (-duration-unit can't be used with -format). The template functions
+bytes and duration format a number of bytes or nanoseconds, and join joins a
+list (such as .Environ) with a separator. For example:
+
+  lp -format '{{.PID}} {{.RSS}} {{.Cmdline}}'
+
+The -dot flag prints the parent/child relationships between the listed
+processes as a graph that can be rendered with Graphviz
+(e.g., lp -all -dot | dot -Tpng -o procs.png).
+
+The -ppid-tree flag shows what started a process: each process selected by
+-pid is listed below its parent, grandparent, and so on up to pid 1 (or the
+first ancestor whose parent has exited), with one generation of indentation
+per row (e.g., lp -all -ppid-tree -pid 1234).
 `)
 	}
 	flag.Parse()
 
+	// $LP_COLS takes precedence over the config file but not over the
+	// column flags on the command line.
+	envCols := os.Getenv("LP_COLS")
+	flag.Visit(func(f *flag.Flag) {
+		if colSelectionFlags[f.Name] {
+			envCols = ""
+		}
+	})
+
+	if err := loadConfig(flag.CommandLine, strings.TrimSpace(envCols) != ""); err != nil {
+		log.Fatal(err)
+	}
+	checkExclusive()
+
+	var err error
+	if f.name, err = compilePattern(*namePattern, *glob); err != nil {
+		log.Fatalf("Bad -name: %s", err)
+	}
+	if f.cmd, err = compilePattern(*cmdPattern, *glob); err != nil {
+		log.Fatalf("Bad -cmd: %s", err)
+	}
+	if f.base, err = compilePattern(*basePattern, *glob); err != nil {
+		log.Fatalf("Bad -base: %s", err)
+	}
+	if f.exe, err = compilePattern(*exePattern, *glob); err != nil {
+		log.Fatalf("Bad -exe: %s", err)
+	}
+
 	var cols column
+	header := true
 	switch {
+	case strings.TrimSpace(envCols) != "":
+		var err error
+		cols, err = parseCols(envCols)
+		if err != nil {
+			log.Fatalf("Bad $LP_COLS: %s", err)
+		}
 	case *colsFlag != "" && *full:
 		log.Fatal("-full and -cols are mutually exclusive")
 	case *colsFlag != "" && *only != "":
@@ -84,35 +237,59 @@ This is useful for piping to other commands (e.g., lp -only pid ... | xargs kill
 	case *only != "" && *full:
 		log.Fatal("-full and -only are mutually exclusive")
 	case *colsFlag != "":
-		for _, colName := range strings.Split(*colsFlag, ",") {
-			colName = strings.TrimSpace(colName)
-			col, ok := colNames[colName]
-			if !ok {
-				log.Fatalf("Unknown -col %q", colName)
-			}
-			cols |= col
+		var err error
+		cols, err = parseCols(*colsFlag)
+		if err != nil {
+			log.Fatalf("Bad -cols: %s", err)
+		}
+	case *colsExcept != "":
+		var err error
+		cols, err = exceptCols(*colsExcept)
+		if err != nil {
+			log.Fatalf("Bad -cols-except: %s", err)
+		}
+	case *colsFile != "":
+		var err error
+		cols, err = readColsFile(*colsFile)
+		if err != nil {
+			log.Fatalf("Bad -fields-from-file: %s", err)
 		}
 	case *full:
 		cols = colPID | colPPID | colUser | colCmdline
+	case *xfull:
+		cols = colPID | colPPID | colUser | colState | colRSS | colCPUTime | colNThreads | colCmdline
 	case *only != "":
 		col, ok := colNames[*only]
 		if !ok {
 			log.Fatalf("Unknown -only column %q", colName)
 		}
 		cols = col
+		header = false
 	default:
 		cols = colPID | colName
 	}
 
+	if (*newest > 0 || *oldest > 0) && header {
+		cols |= colStarted
+	}
+
+	if *numericUID && f.users != nil {
+		uids, err := uidsForUsers(f.users)
+		if err != nil {
+			log.Fatalf("Bad -user: %s", err)
+		}
+		f.users = uids
+	}
+
 	needCols := cols
 	if !*all {
-		f.thisPID = os.Getpid()
-		needCols |= colPID
-		u, err := user.Current()
-		if err != nil {
-			log.Fatal(err)
+		if !*self {
+			f.thisPID = os.Getpid()
+			needCols |= colPID
+		}
+		if f.users == nil {
+			f.user = currentUserName(*numericUID)
 		}
-		f.user = u.Username
 		needCols |= colUser
 	}
 	if f.name != nil {
@@ -121,7 +298,18 @@ This is useful for piping to other commands (e.g., lp -only pid ... | xargs kill
 	if f.cmd != nil {
 		needCols |= colCmdline
 	}
-	if f.pid != 0 {
+	if f.base != nil {
+		needCols |= colBase
+	}
+	if f.exe != nil {
+		needCols |= colExe
+	}
+	if *fromStdin {
+		if err := readPIDs(os.Stdin, &f.pids); err != nil {
+			log.Fatalf("Error reading PIDs from stdin: %s", err)
+		}
+	}
+	if f.pids != nil {
 		needCols |= colPID
 	}
 	if f.ppid != 0 {
@@ -130,410 +318,1166 @@ This is useful for piping to other commands (e.g., lp -only pid ... | xargs kill
 	if f.pgid != 0 {
 		needCols |= colPGID
 	}
-
-	l := newLister(&f, needCols)
-	ps, err := l.list()
-	if err != nil {
-		log.Fatal(err)
+	if len(f.env) > 0 {
+		needCols |= colEnviron
 	}
-
-	tw := newTableWriter(cols, *only == "")
-	defer tw.write(os.Stdout)
-	for _, p := range ps {
-		p.write(tw, cols)
+	if f.running {
+		needCols |= colState
 	}
-}
-
-type lister struct {
-	clockTick time.Duration
-	pageSize  bytesize
-
-	needCols column
-	buf      []byte
-	users    map[uint32]string
-	uptime   time.Duration
-	filter   *filter
-}
-
-func newLister(f *filter, needCols column) *lister {
-	clockTicksPerSec := C.sysconf(C._SC_CLK_TCK)
-	return &lister{
-		clockTick: time.Second / time.Duration(clockTicksPerSec),
-		pageSize:  bytesize(os.Getpagesize()),
-		needCols:  needCols,
-		users:     make(map[uint32]string),
-		filter:    f,
+	if f.minFDs > 0 {
+		needCols |= colNFDs
 	}
-}
-
-func (l *lister) list() ([]*process, error) {
-	var err error
-	l.uptime, err = l.getUptime()
-	if err != nil {
-		return nil, err
+	if f.minThreads > 0 {
+		needCols |= colNThreads
 	}
-	f, err := os.Open("/proc")
-	if err != nil {
-		return nil, err
+	if f.leaders {
+		needCols |= colPID | colPGID | colSID
 	}
-	defer f.Close()
-	fis, err := f.Readdir(0)
-	if err != nil {
-		return nil, err
+	if *newest > 0 || *oldest > 0 || !f.since.IsZero() {
+		needCols |= colStarted
 	}
-	var ps []*process
-	for _, fi := range fis {
-		p, err := l.loadProcess(fi)
-		if err == errNotAProcess {
-			continue
+	if killSig != 0 && *fromStdin && !*yes {
+		// The PIDs were read from stdin, so it can't be used to confirm.
+		log.Fatal("-kill with -stdin requires -yes")
+	}
+	if *ppidTree {
+		if f.pids == nil && !*fromStdin {
+			log.Fatal("-ppid-tree requires -pid or -stdin")
 		}
-		// The pseudo-files could could disappear as we're trying to
-		// read them if the process exits.
-		if errors.Is(err, os.ErrNotExist) {
-			continue
+		// The indented column.
+		if !cols.has(colCmdline) {
+			cols |= colName
 		}
+		needCols |= cols | colPPID
+	}
+	if *memSum {
+		needCols |= colRSS | colPSS | colUSS
+	}
+	if *summary {
+		needCols |= colState | colRSS
+	}
+	var tmpl *template.Template
+	if *format != "" {
+		var tmplCols column
+		tmpl, tmplCols, err = parseFormat(*format)
 		if err != nil {
-			return nil, err
+			log.Fatalf("Bad -format: %s", err)
 		}
-		ps = append(ps, p)
-	}
-	if l.needCols.has(colNChild | colNDesc) {
-		fillChildDesc(ps)
+		needCols |= tmplCols
 	}
-	i := 0
-	for _, p := range ps {
-		if l.filter.include(p) {
-			ps[i] = p
-			i++
+	var uniqCol column
+	if *uniq != "" {
+		var ok bool
+		uniqCol, ok = colNames[*uniq]
+		if !ok {
+			log.Fatalf("Unknown -uniq column %q", *uniq)
 		}
+		needCols |= uniqCol
 	}
-	ps = ps[:i]
-	return ps, nil
-}
-
-func (l *lister) getUptime() (time.Duration, error) {
-	f, err := os.Open("/proc/uptime")
-	if err != nil {
-		return 0, err
+	if *byUser {
+		needCols |= colUser | colRSS | colCPUTime
 	}
-	defer f.Close()
-	b, err := l.readAll(f)
-	if err != nil {
-		return 0, err
+	if *states {
+		needCols |= colState
 	}
-	i := bytes.IndexByte(b, ' ')
-	if i < 0 {
-		return 0, errors.New("malformed /proc/uptime")
+	if *dot {
+		needCols |= colPID | colPPID | colName
 	}
-	return time.ParseDuration(string(b[:i]) + "s")
-}
-
-type process struct {
-	pid      int
-	name     string
-	cmdline  string
-	ppid     int
-	pgid     int
-	rss      bytesize
-	uptime   time.Duration
-	utime    time.Duration
-	stime    time.Duration
-	cutime   time.Duration
-	cstime   time.Duration
-	cpuTime  time.Duration
-	nthreads int32
-	nfds     int64
-	nchild   int64
-	ndesc    int64
-	user     string
-}
-
-var errNotAProcess = errors.New("/proc dir is not a pid")
-
-func (l *lister) loadProcess(fi os.FileInfo) (*process, error) {
-	var p process
-	var err error
-	p.pid, err = strconv.Atoi(fi.Name())
+	if needCols.has(colPCPU) {
+		needCols |= colUtime | colStime | colUptime
+	}
+	if needCols.has(colPName) {
+		needCols |= colPPID | colName
+	}
+	if needCols.has(colDepth | colReparented) {
+		needCols |= colPPID
+	}
+	if needCols.has(colBase) {
+		needCols |= colName
+	}
+	if needCols.has(colStartedISO) {
+		needCols |= colStarted
+	}
+	// Allow -sep '\t' and the like.
+	sepString, err := strconv.Unquote(`"` + strings.ReplaceAll(*sep, `"`, `\"`) + `"`)
 	if err != nil {
-		return nil, errNotAProcess
+		log.Fatalf("Bad -sep %q: %s", *sep, err)
 	}
-
-	uid := fi.Sys().(*syscall.Stat_t).Uid
-	p.user = l.getUser(uid)
-
-	basePath := "/proc/" + fi.Name()
-	if err := l.parseStat(&p, basePath+"/stat"); err != nil {
-		return nil, err
+	var colorize bool
+	switch *color {
+	case "auto":
+		colorize = termWidth() > 0
+	case "always":
+		colorize = true
+	case "never":
+	default:
+		log.Fatalf("Bad -color %q (must be auto, always, or never)", *color)
 	}
-	if l.needCols.has(colCmdline) {
-		if err := l.parseCmdline(&p, basePath+"/cmdline"); err != nil {
-			return nil, err
+	// Bold doesn't depend on color, so -bold-max-rss only checks for a
+	// terminal.
+	*boldRSS = *boldRSS && termWidth() > 0
+	if *boldRSS {
+		needCols |= colRSS
+	}
+	// For coloring; only useful when listing other users' processes.
+	var currentUser string
+	if colorize {
+		needCols |= colState | colUptime | colSelfCPU
+		if f.user == "" {
+			currentUser = currentUserName(*numericUID)
+			needCols |= colUser
 		}
 	}
-	if l.needCols.has(colNFDs) {
-		if err := l.parseFDs(&p, basePath+"/fd"); err != nil {
-			return nil, err
+
+	if unsupported := needCols &^ supportedCols; unsupported != 0 {
+		var names []string
+		for col := column(1); col < numCols; col <<= 1 {
+			if unsupported.has(col) {
+				names = append(names, col.String())
+			}
 		}
+		log.Fatalf("Column(s) needed for this query are not supported on %s: %s",
+			runtime.GOOS, strings.Join(names, ","))
 	}
 
-	return &p, nil
-}
+	iecBytes = *iec
 
-func (l *lister) getUser(uid uint32) string {
-	if name, ok := l.users[uid]; ok {
-		return name
+	l := newLister(&f, needCols)
+	if *debug {
+		l.timings = newTimings()
+		defer func() {
+			l.timings.lap("output")
+			l.timings.write(os.Stderr)
+			// Measured at the end, after all the buffers have grown.
+			rss, err := l.selfRSS()
+			if err != nil {
+				log.Printf("Error reading lp's own rss: %s", err)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "%-10s %s\n", "lp rss", rss)
+		}()
 	}
-	var name string
-	if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
-		name = u.Username
+	l.procRoot = *procRoot
+	l.threads = *threads
+	if killSig != 0 && l.foreignPIDs() {
+		// The pids may belong to another PID namespace; signaling the
+		// same numbers here could hit unrelated processes.
+		log.Fatal("-kill can't be used with -proc-root")
 	}
-	l.users[uid] = name
-	return name
-}
-
-func (l *lister) parseStat(p *process, path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
+	l.numericUID = *numericUID
+	l.parents = *dot || *ppidTree
+	if *cpuTotal {
+		l.ncpu = runtime.NumCPU()
 	}
-	defer f.Close()
-
-	stat, err := l.readAll(f)
+	ps, err := l.list(context.Background())
 	if err != nil {
-		return err
+		log.Fatal(err)
+	}
+	switch {
+	case *newest > 0:
+		ps = firstByStart(ps, *newest, true)
+		l.timings.lap("sort")
+	case *oldest > 0:
+		ps = firstByStart(ps, *oldest, false)
+		l.timings.lap("sort")
 	}
 
-	for col := 1; ; col++ {
-		for stat[0] == ' ' {
-			stat = stat[1:]
+	if *count {
+		fmt.Println(len(ps))
+		return
+	}
+	if *byUser {
+		userSummary(ps).write(os.Stdout)
+		return
+	}
+	if *states {
+		stateSummary(ps).write(os.Stdout)
+		return
+	}
+	if uniqCol != 0 {
+		uniqSummary(ps, uniqCol).write(os.Stdout)
+		return
+	}
+	if *memSum {
+		tw, unknown := memSummary(ps)
+		tw.write(os.Stdout)
+		if unknown > 0 {
+			log.Printf("Note: the totals exclude %d process(es) whose memory usage couldn't be read", unknown)
 		}
-		if col == 2 { // comm
-			if stat[0] != '(' {
-				return errors.New("malformed /stat")
-			}
-			i := bytes.LastIndexByte(stat, ')')
-			p.name = string(stat[1:i])
-			stat = stat[i+1:]
-			continue
+		return
+	}
+	if *dot {
+		if err := writeDOT(os.Stdout, ps); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
 
-		i := bytes.IndexByte(stat, ' ')
-		b := stat[:i]
-		var err error
-		stat = stat[i:]
-		switch col {
-		case 4: // ppid
-			p.ppid, err = parseIntb(b)
-			if err != nil {
-				return err
-			}
-		case 5: // pgrp
-			p.pgid, err = parseIntb(b)
-			if err != nil {
-				return err
-			}
-		case 14: // utime
-			utime, err := parseUint32b(b)
-			if err != nil {
-				return err
-			}
-			p.utime = time.Duration(utime) * l.clockTick
-		case 15: // stime
-			stime, err := parseUint32b(b)
-			if err != nil {
-				return err
-			}
-			p.stime = time.Duration(stime) * l.clockTick
-		case 16: // cutime
-			cutime, err := parseUint32b(b)
-			if err != nil {
-				return err
-			}
-			p.cutime = time.Duration(cutime) * l.clockTick
-		case 17: // cstime
-			cstime, err := parseUint32b(b)
-			if err != nil {
-				return err
-			}
-			p.cstime = time.Duration(cstime) * l.clockTick
-			p.cpuTime = p.utime + p.stime + p.cutime + p.cstime
-		case 20: // num_threads
-			p.nthreads, err = parseInt32b(b)
-			if err != nil {
-				return err
-			}
-		case 22: // starttime
-			startTime, err := parseUint64b(b)
-			if err != nil {
-				return err
+	if *ppidTree {
+		ps = ancestorRows(ps, cols.has(colCmdline))
+	}
+
+	if tmpl != nil {
+		if err := writeFormatted(os.Stdout, tmpl, ps); err != nil {
+			log.Fatal(err)
+		}
+	} else if *tsv {
+		if err := writeTSV(os.Stdout, cols, ps, durationUnit, *units); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if *summary {
+			// Keep the summary out of the way of tools reading
+			// the table.
+			w := os.Stderr
+			if termWidth() > 0 {
+				w = os.Stdout
 			}
-			uptime := l.uptime - time.Duration(startTime)*l.clockTick
-			if uptime < 0 {
-				uptime = 0
+			fmt.Fprintln(w, summaryLine(ps))
+		}
+		confs := colConfsFor(cols)
+		for i, conf := range confs {
+			confs[i].name = conf.header(*units, false, durationUnit)
+		}
+		tw := newTableWriterConfs(confs, header)
+		tw.wide = *wide
+		if *width > 0 {
+			tw.termWidth = *width
+		}
+		tw.sep = sepString
+		tw.durationUnit = durationUnit
+		tw.maxColWidth = *maxWidth
+		tw.cmdWidth = *cmdWidth
+		boldIdx := -1
+		if *boldRSS {
+			boldIdx = maxRSS(ps)
+		}
+		for i, p := range ps {
+			p.write(tw, cols)
+			var color string
+			if colorize {
+				color = p.color(currentUser)
 			}
-			p.uptime = uptime
-		case 24: // rss
-			pages, err := parseInt32b(b)
-			if err != nil {
-				return err
+			if i == boldIdx {
+				color += ansiBold
 			}
-			p.rss = bytesize(pages) * l.pageSize
-			// Done
-			return nil
+			tw.setColor(color)
+		}
+		if *total {
+			tw.appendFooter(totalRows(ps, cols, durationUnit)...)
 		}
+		tw.write(os.Stdout)
 	}
-}
-
-var nullReplacer = strings.NewReplacer("\x00", " ")
 
-func (l *lister) parseCmdline(p *process, path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
+	if killSig != 0 {
+		if !*self {
+			ps = excludePID(ps, os.Getpid())
+		}
+		if len(ps) == 0 {
+			return
+		}
+		if !*yes && !confirm(fmt.Sprintf("Send %s to %d process(es)?", unix.SignalName(killSig), len(ps))) {
+			os.Exit(1)
+		}
+		n, err := killAll(ps, killSig)
+		log.Printf("Sent %s to %d process(es)", unix.SignalName(killSig), n)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
+}
 
-	cmdline, err := l.readAll(f)
-	if err != nil {
-		return err
+// excludePID returns ps without the process (or the threads of the process)
+// with the given PID.
+func excludePID(ps []*process, pid int) []*process {
+	var filtered []*process
+	for _, p := range ps {
+		if p.tgid != pid {
+			filtered = append(filtered, p)
+		}
 	}
-	p.cmdline = strings.TrimSpace(nullReplacer.Replace(string(cmdline)))
-	return nil
+	return filtered
 }
 
-func (l *lister) parseFDs(p *process, path string) error {
-	f, err := os.Open(path)
-	if errors.Is(err, os.ErrPermission) {
-		p.nfds = -1
-		return nil
-	}
-	if err != nil {
-		return err
+// confirm asks the user a yes/no question on stderr and reads the answer
+// from stdin.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
 	}
-	p.nfds, l.buf, err = direntCount(f, l.buf)
-	return err
+	return false
 }
 
-func fillChildDesc(ps []*process) {
-	byPID := make(map[int]*process)
-	for _, p := range ps {
-		byPID[p.pid] = p
-	}
+// killAll sends sig to each process in ps. In -threads mode, each process
+// is signaled once no matter how many of its threads are listed. Processes
+// that exited in the meantime are skipped. killAll returns the number of
+// signals sent and the first error encountered, if any.
+func killAll(ps []*process, sig syscall.Signal) (int, error) {
+	var n int
+	var firstErr error
+	seen := make(map[int]bool)
 	for _, p := range ps {
-		if parent, ok := byPID[p.ppid]; ok {
-			parent.nchild++
+		if seen[p.tgid] {
+			continue
 		}
-	}
-	rem := ps
-	for len(rem) > 0 {
-		var next []*process
-		for _, p := range rem {
-			parent, ok := byPID[p.ppid]
-			if !ok {
-				continue
+		seen[p.tgid] = true
+		err := syscall.Kill(p.tgid, sig)
+		switch {
+		case err == nil:
+			n++
+		case err == syscall.ESRCH:
+		default:
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error signaling process %d: %s", p.tgid, err)
 			}
-			parent.ndesc++
-			next = append(next, parent)
 		}
-		rem = next
 	}
+	return n, firstErr
 }
 
-// readAll attempts to use a single ReadAt to get the entire contents in a
-// single syscall and falls back to ioutil.ReadAll otherwise.
-func (l *lister) readAll(f *os.File) ([]byte, error) {
-	l.buf = l.buf[:cap(l.buf)]
-	if len(l.buf) > 0 {
-		n, err := f.ReadAt(l.buf, 0)
-		if err == nil || err != io.EOF {
-			return l.buf[:n], err
+// parseCols parses a comma-separated list of column names.
+func parseCols(s string) (column, error) {
+	var cols column
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		col, ok := colNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown column %q", name)
 		}
+		cols |= col
 	}
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		return nil, err
-	}
-	return ioutil.ReadAll(f)
-}
-
-func parseIntb(b []byte) (int, error) {
-	return strconv.Atoi(unsafeString(b))
+	return cols, nil
 }
 
-func parseInt32(s string) (int32, error) {
-	n, err := strconv.ParseInt(s, 10, 32)
+// exceptCols returns every column supported on this OS except those in the
+// comma-separated list s (for -cols-except).
+func exceptCols(s string) (column, error) {
+	except, err := parseCols(s)
 	if err != nil {
 		return 0, err
 	}
-	return int32(n), nil
-}
-
-func parseInt32b(b []byte) (int32, error) {
-	return parseInt32(unsafeString(b))
+	cols := supportedCols &^ except
+	if cols == 0 {
+		return 0, errors.New("no columns left to display")
+	}
+	return cols, nil
 }
 
-func parseUint32(s string) (uint32, error) {
-	n, err := strconv.ParseUint(s, 10, 32)
+// readColsFile reads a list of columns from a file for -fields-from-file.
+// The columns are separated by commas or newlines; blank lines and lines
+// starting with # are ignored.
+func readColsFile(path string) (column, error) {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return 0, err
 	}
-	return uint32(n), nil
+	var names []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return 0, fmt.Errorf("%s lists no columns", path)
+	}
+	return parseCols(strings.Join(names, ","))
 }
 
-func parseUint32b(b []byte) (uint32, error) {
-	return parseUint32(unsafeString(b))
+// configFlags are the flags that may be set in the config file. They only
+// affect how the processes are displayed, so a stray line can't make every
+// run of lp filter differently or (say) kill processes.
+var configFlags = map[string]bool{
+	"cols": true, "cols-except": true, "fields-from-file": true, "full": true, "xfull": true, "only": true,
+	"total": true, "summary": true, "color": true, "bold-max-rss": true,
+	"wide": true, "width": true, "max-col-width": true, "cmd-width": true, "sep": true,
+	"duration-unit": true, "iec": true, "units": true, "numeric-uid": true, "cpu-total": true,
 }
 
-func parseUint64b(b []byte) (uint64, error) {
-	return strconv.ParseUint(unsafeString(b), 10, 64)
-}
+// colSelectionFlags are the flags that choose which columns to display.
+var colSelectionFlags = map[string]bool{"cols": true, "cols-except": true, "fields-from-file": true, "full": true, "xfull": true, "only": true}
 
-func unsafeString(b []byte) string {
-	var s string
-	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
-	sh.Data = (*reflect.SliceHeader)(unsafe.Pointer(&b)).Data
-	sh.Len = len(b)
-	return s
+// loadConfig sets flags in fs from the user's config file (if there is
+// one), skipping the flags that were already set on the command line or that
+// conflict with them. If envCols is set, the columns were chosen by $LP_COLS,
+// so the column selection flags are skipped as well.
+func loadConfig(fs *flag.FlagSet, envCols bool) error {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil // no config dir, so no config file
+	}
+	name := filepath.Join(dir, "lp", "config")
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return applyConfig(fs, f, name, envCols)
+}
+
+// applyConfig sets flags in fs from the key=value lines of a config file
+// read from r (and called name, for error messages). See loadConfig.
+func applyConfig(fs *flag.FlagSet, r io.Reader, name string, envCols bool) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	colsSet := envCols
+	for col := range colSelectionFlags {
+		colsSet = colsSet || set[col]
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := line, ""
+		i := strings.IndexByte(line, '=')
+		if i >= 0 {
+			key, value = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+		key = strings.TrimLeft(key, "-")
+		f := fs.Lookup(key)
+		if f == nil {
+			return fmt.Errorf("%s:%d: unknown flag %q", name, lineNum, key)
+		}
+		if !configFlags[key] {
+			return fmt.Errorf("%s:%d: flag %q can't be set in the config file", name, lineNum, key)
+		}
+		if i < 0 {
+			if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !bf.IsBoolFlag() {
+				return fmt.Errorf("%s:%d: flag %q needs a value", name, lineNum, key)
+			}
+			value = "true"
+		}
+		if set[key] || (colSelectionFlags[key] && colsSet) || conflictsWithAny(key, set) {
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for flag %q: %s", name, lineNum, value, key, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// conflictsWithAny reports whether the flag called name conflicts with any
+// of the flags in set.
+func conflictsWithAny(name string, set map[string]bool) bool {
+	for other := range set {
+		if conflicts(name, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// currentUserName returns the name (or, if numeric is set, the UID) of the
+// user running lp, as it appears in the user column.
+func currentUserName(numeric bool) string {
+	u, err := user.Current()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if numeric {
+		return u.Uid
+	}
+	return u.Username
+}
+
+// uidsForUsers converts the usernames given to -user to UIDs, for use with
+// -numeric-uid. (Names that are already UIDs are left alone.)
+func uidsForUsers(users map[string]bool) (map[string]bool, error) {
+	uids := make(map[string]bool)
+	for name := range users {
+		if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+			uids[name] = true
+			continue
+		}
+		u, err := user.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		uids[u.Uid] = true
+	}
+	return uids, nil
+}
+
+// exclusiveFlags lists groups of flags that can't be used together: the
+// first flag of each group conflicts with each of the others.
+var exclusiveFlags = [][]string{
+	{"by-user", "cols", "cols-except", "fields-from-file", "full", "xfull", "only", "total"},
+	{"count-states", "cols", "cols-except", "fields-from-file", "full", "xfull", "only", "total", "by-user"},
+	{"kill", "by-user", "count-states"},
+	{"uniq", "cols", "cols-except", "fields-from-file", "full", "xfull", "only", "total", "by-user", "count-states", "dot", "kill"},
+	{"mem-summary", "cols", "cols-except", "fields-from-file", "full", "xfull", "only", "total", "by-user", "count-states", "dot", "kill", "uniq"},
+	{"format", "cols", "cols-except", "fields-from-file", "full", "xfull", "only", "total", "by-user", "count-states", "dot", "uniq", "mem-summary", "duration-unit"},
+	{"count", "cols", "cols-except", "fields-from-file", "full", "xfull", "only", "total", "by-user", "count-states", "dot", "uniq", "mem-summary", "format", "kill"},
+	{"user", "all"},
+	{"ppid-tree", "by-user", "count-states", "dot", "uniq", "mem-summary", "format", "count", "newest", "oldest", "kill"},
+	{"summary", "by-user", "count-states", "dot", "uniq", "mem-summary", "format", "count", "tsv"},
+	{"tsv", "by-user", "count-states", "dot", "uniq", "mem-summary", "format", "count", "only", "total", "sep"},
+	{"fields-from-file", "cols", "full", "xfull", "only"},
+	{"xfull", "cols", "full", "only"},
+	{"cols-except", "cols", "fields-from-file", "full", "xfull", "only"},
+	{"total", "threads"},
+	{"wide", "width"},
+	{"newest", "oldest"},
+	{"dot", "cols", "cols-except", "fields-from-file", "full", "xfull", "only", "total", "by-user", "count-states", "threads", "kill"},
+}
+
+// conflicts reports whether the flags a and b can't be used together.
+func conflicts(a, b string) bool {
+	for _, group := range exclusiveFlags {
+		for _, other := range group[1:] {
+			if (group[0] == a && other == b) || (group[0] == b && other == a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkExclusive exits with an error if any two flags that can't be used
+// together were set, whether on the command line or in the config file.
+func checkExclusive() {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, group := range exclusiveFlags {
+		if !set[group[0]] {
+			continue
+		}
+		for _, other := range group[1:] {
+			if set[other] {
+				log.Fatalf("-%s and -%s are mutually exclusive", group[0], other)
+			}
+		}
+	}
+}
+
+// A lister loads information about processes. The platform-specific parts
+// (newLister and loadAll) are implemented separately for each supported OS
+// in proc_$GOOS.go; the rest is shared.
+type lister struct {
+	clockTick time.Duration
+	pageSize  bytesize
+	procRoot  string
+	threads   bool // list threads rather than processes
+	parents   bool // set process.parent (from the unfiltered list); implied by pname and depth
+	ncpu      int  // if > 0, divide pcpu by this number of CPUs
+	// numericUID means to show UIDs rather than usernames.
+	numericUID bool
+
+	needCols      column
+	lastStatField int
+	// buf is scratch space for reading files and directories. It grows
+	// as needed to hold the largest file read. On Linux, loadAll takes
+	// it from scratchPool and puts it back when it's done; while it runs,
+	// the buffer belongs to the goroutine running it, so a lister may only
+	// be used by one goroutine at a time (concurrent loading would need
+	// one lister, and buffer, per worker).
+	buf      []byte
+	users    map[uint32]string // see getUser
+	uptime   time.Duration
+	bootTime time.Time // derived from uptime once per list
+	allCaps  uint64    // mask of every capability the kernel knows about
+	// listenPorts maps the inode of each listening socket to its port
+	// (such as 22/tcp), for the ports column.
+	listenPorts map[uint64]string
+	filter      *filter
+	timings     *timings // for -debug; nil otherwise
+}
+
+// foreignPIDs reports whether the pids in l.procRoot might not be the ones
+// that lp's system calls refer to (because -proc-root was given).
+func (l *lister) foreignPIDs() bool {
+	return filepath.Clean(l.procRoot) != "/proc"
+}
+
+// timings accumulates the time spent in each phase of running lp (such as
+// reading a particular /proc file for every process), for -debug. The
+// methods do nothing on a nil *timings.
+type timings struct {
+	start time.Time
+	last  time.Time
+	names []string // in the order first seen
+	d     map[string]time.Duration
+}
+
+func newTimings() *timings {
+	now := time.Now()
+	return &timings{start: now, last: now, d: make(map[string]time.Duration)}
+}
+
+// mark starts timing the next phase.
+func (t *timings) mark() {
+	if t != nil {
+		t.last = time.Now()
+	}
+}
+
+// lap adds the time since the last call to mark or lap to the phase name.
+func (t *timings) lap(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	if _, ok := t.d[name]; !ok {
+		t.names = append(t.names, name)
+	}
+	t.d[name] += now.Sub(t.last)
+	t.last = now
+}
+
+// write writes the time taken by each phase to w, followed by the total
+// time between newTimings and the last lap (including any time that wasn't
+// attributed to a phase).
+func (t *timings) write(w io.Writer) {
+	for _, name := range t.names {
+		fmt.Fprintf(w, "%-10s %s\n", name, formatDuration(t.d[name]))
+	}
+	fmt.Fprintf(w, "%-10s %s\n", "total", formatDuration(t.last.Sub(t.start)))
+}
+
+// list reads all processes and returns those that pass the filter.
+// It returns ctx.Err() if ctx is canceled partway through the scan.
+func (l *lister) list(ctx context.Context) ([]*process, error) {
+	l.timings.mark()
+	ps, err := l.loadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.timings.mark()
+	if l.needCols.has(colNChild | colNDesc) {
+		fillChildDesc(ps)
+		l.timings.lap("nchild")
+	}
+	if l.parents || l.needCols.has(colPName|colDepth) {
+		byPID := pidMap(ps)
+		for _, p := range ps {
+			p.parent = byPID[p.ppid]
+			switch {
+			case p.parent != nil:
+				p.pname = p.parent.name
+			case p.ppid != 0:
+				p.pname = "?" // the parent exited
+			}
+		}
+		l.timings.lap("parents")
+	}
+	if l.needCols.has(colDepth) {
+		fillDepth(ps)
+		l.timings.lap("depth")
+	}
+	i := 0
+	for _, p := range ps {
+		if l.filter.include(p) {
+			ps[i] = p
+			i++
+		}
+	}
+	ps = ps[:i]
+	l.timings.lap("filter")
+	if l.needCols.has(colPCPU) {
+		for _, p := range ps {
+			p.pcpu = l.pcpu(p)
+		}
+		l.timings.lap("pcpu")
+	}
+	return ps, nil
+}
+
+// pcpu calculates the pcpu column for p, which must have utime, stime, and
+// uptime filled in.
+func (l *lister) pcpu(p *process) percent {
+	if p.uptime <= 0 {
+		return 0
+	}
+	pct := 100 * float64(p.utime+p.stime) / float64(p.uptime)
+	if l.ncpu > 0 {
+		pct /= float64(l.ncpu)
+	}
+	return percent(pct)
+}
+
+type process struct {
+	pid      int // thread ID, when listing threads
+	tgid     int // thread group ID (the pid of the owning process)
+	name     string
+	state    string
+	cmdline  string
+	ppid     int
+	pgid     int
+	rss      bytesize
+	uptime   time.Duration
+	utime    time.Duration
+	stime    time.Duration
+	cutime   time.Duration
+	cstime   time.Duration
+	cpuTime  time.Duration
+	selfCPU  time.Duration
+	nthreads int32
+	ntasks   int64
+	nfds     int64
+	nsockets int64
+	nfiles   int64
+	nchild   int64
+	ndesc    int64
+	user     string
+
+	schedPolicy string
+	affinity    string
+	lastCPU     int
+	guestTime   time.Duration
+	blkioDelay  time.Duration
+	rtPrio      int
+	nmaps       int64
+	pss         bytesize
+	uss         bytesize
+	swap        bytesize
+	text        bytesize
+	data        bytesize
+	pcpu        percent
+	start       time.Time // zero if unknown
+	pname       string
+	depth       int
+	arg0        string
+	sid         int
+	base        string
+	exe         string // "" if there is none (kernel threads); "?" if unreadable
+	groups      string
+	ruid        string
+	euid        string
+	loginUID    string
+	seccomp     string
+	caps        string
+	umask       string
+	sigPnd      string
+	sigBlk      string
+	sigIgn      string
+	sigCgt      string
+	container   string
+	pidNS       string
+	netNS       string
+	mntNS       string
+	nsPID       int64 // -1 if unknown
+	ports       string
+
+	// environ holds the KEY=VALUE pairs of the process environment.
+	// It is nil (as opposed to empty) if the environment is unreadable.
+	environ []string
+
+	// parent is the parent process, if lister.parents is set and the
+	// parent was found. (It may have been excluded by the filter.)
+	parent *process
+}
+
+// newUserCache returns the initial contents of lister.users, which is
+// created by the first call to getUser.
+func newUserCache() map[uint32]string {
+	// Looking up users one at a time with user.LookupId can be slow (it
+	// may go through NSS), so prime the cache with the contents of
+	// /etc/passwd. UIDs that aren't listed there fall back to
+	// user.LookupId in getUser.
+	if users, err := readPasswd("/etc/passwd"); err == nil {
+		return users
+	}
+	return make(map[uint32]string)
+}
+
+// getUser returns the name of the user with the given UID (or the UID
+// itself, if the user is unknown or l.numericUID is set).
+func (l *lister) getUser(uid uint32) string {
+	if l.numericUID {
+		return strconv.FormatUint(uint64(uid), 10)
+	}
+	if l.users == nil {
+		l.users = newUserCache()
+	}
+	if name, ok := l.users[uid]; ok {
+		return name
+	}
+	// If the lookup fails (common in containers without a populated
+	// passwd database), fall back to displaying the numeric UID.
+	name := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	l.users[uid] = name
+	return name
+}
+
+// readPasswd reads a passwd(5) file and returns a map from UID to username.
+func readPasswd(path string) (map[uint32]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePasswd(f)
+}
+
+func parsePasswd(r io.Reader) (map[uint32]string, error) {
+	users := make(map[uint32]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// name:password:UID:GID:GECOS:directory:shell
+		fields := strings.SplitN(line, ":", 4)
+		if len(fields) < 4 {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		// Like getpwuid, the first entry for a UID wins.
+		if _, ok := users[uint32(uid)]; !ok {
+			users[uint32(uid)] = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+var nullReplacer = strings.NewReplacer("\x00", " ")
+
+// formatCmdline formats NUL-separated command-line arguments for display.
+func formatCmdline(args []byte) string {
+	return strings.TrimSpace(nullReplacer.Replace(string(args)))
+}
+
+// cmdlineCols are the columns derived from the NUL-separated arguments.
+const cmdlineCols = colCmdline | colArg0 | colBase
+
+// setCmdline fills in the cmdline columns of p from the NUL-separated
+// arguments. (The base column uses p.name, which must already be set.)
+func (l *lister) setCmdline(p *process, args []byte) {
+	if l.needCols.has(colCmdline) {
+		p.cmdline = formatCmdline(args)
+	}
+	if l.needCols.has(colBase) {
+		p.base = baseName(args, p.name)
+	}
+	if i := bytes.IndexByte(args, 0); i >= 0 {
+		args = args[:i]
+	}
+	if l.needCols.has(colArg0) {
+		p.arg0 = string(args)
+	}
+}
+
+// baseName returns the base column given the NUL-separated arguments and the
+// process name.
+func baseName(args []byte, name string) string {
+	arg0 := args
+	single := true
+	if i := bytes.IndexByte(args, 0); i >= 0 {
+		arg0 = args[:i]
+		single = len(bytes.Trim(args[i:], "\x00")) == 0
+	}
+	if len(arg0) == 0 {
+		return "[" + name + "]"
+	}
+	// Some programs overwrite their arguments with a single status line
+	// (e.g., "sshd: alice@pts/0"); just use the first word of those. A
+	// lone absolute path whose base starts with the process name is a
+	// path that contains spaces (e.g., "/opt/My App/bin/x") rather than
+	// a status line, though.
+	if single {
+		i := bytes.IndexByte(arg0, ' ')
+		isPath := arg0[0] == '/' && strings.HasPrefix(pathBase(arg0), name)
+		if i >= 0 && !isPath {
+			arg0 = arg0[:i]
+		}
+	}
+	return pathBase(arg0)
+}
+
+// pathBase is like path.Base for a non-empty path, except that it returns
+// "/" as "".
+func pathBase(p []byte) string {
+	p = bytes.TrimRight(p, "/")
+	if i := bytes.LastIndexByte(p, '/'); i >= 0 {
+		p = p[i+1:]
+	}
+	return string(p)
+}
+
+// firstByStart sorts ps by start time (newest first, if newestFirst is set)
+// and returns the first n.
+func firstByStart(ps []*process, n int, newestFirst bool) []*process {
+	sort.SliceStable(ps, func(i, j int) bool {
+		if newestFirst {
+			return ps[i].start.After(ps[j].start)
+		}
+		return ps[i].start.Before(ps[j].start)
+	})
+	if len(ps) > n {
+		ps = ps[:n]
+	}
+	return ps
+}
+
+// pidMap indexes ps by pid.
+func pidMap(ps []*process) map[int]*process {
+	byPID := make(map[int]*process)
+	for _, p := range ps {
+		byPID[p.pid] = p
+	}
+	return byPID
+}
+
+// fillChildDesc sets nchild and ndesc for each process in ps. Only
+// processes are counted: in -threads mode, each thread gets the counts of
+// the process it belongs to.
+func fillChildDesc(ps []*process) {
+	var procs []*process
+	for _, p := range ps {
+		if p.pid == p.tgid {
+			procs = append(procs, p)
+		}
+	}
+	byPID := pidMap(procs)
+	for _, p := range procs {
+		if parent, ok := byPID[p.ppid]; ok {
+			parent.nchild++
+		}
+	}
+	rem := procs
+	for len(rem) > 0 {
+		var next []*process
+		for _, p := range rem {
+			parent, ok := byPID[p.ppid]
+			if !ok {
+				continue
+			}
+			parent.ndesc++
+			next = append(next, parent)
+		}
+		rem = next
+	}
+	for _, p := range ps {
+		if p.pid == p.tgid {
+			continue
+		}
+		if leader, ok := byPID[p.tgid]; ok {
+			p.nchild, p.ndesc = leader.nchild, leader.ndesc
+		}
+	}
+}
+
+// fillDepth sets the depth of each process in ps, which must have parent
+// set. Each process's depth is computed once and reused for its
+// descendants.
+func fillDepth(ps []*process) {
+	done := make(map[*process]bool)
+	var chain []*process
+	for _, p := range ps {
+		// Walk up to the first process that's done or has no parent.
+		// Marking the processes as we go means that a cycle (which is
+		// possible if pids were reused during the scan) can't make us
+		// loop forever.
+		chain = chain[:0]
+		q := p
+		for q != nil && !done[q] {
+			done[q] = true
+			chain = append(chain, q)
+			q = q.parent
+		}
+		depth := -1
+		if q != nil && !containsProcess(chain, q) {
+			depth = q.depth
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			depth++
+			chain[i].depth = depth
+		}
+	}
+}
+
+// ancestorRows returns, for each process in ps, its chain of ancestors
+// followed by the process itself. The chain begins with pid 1 or the first
+// ancestor whose parent wasn't found (such as one that exited). The returned
+// processes are copies whose names (or cmdlines, if indentCmdline is set)
+// are indented by two spaces per generation.
+func ancestorRows(ps []*process, indentCmdline bool) []*process {
+	var rows []*process
+	var chain []*process
+	for _, p := range ps {
+		chain = chain[:0]
+		// Stop at a repeat in case of a cycle (see fillDepth).
+		for q := p; q != nil && !containsProcess(chain, q); q = q.parent {
+			chain = append(chain, q)
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			row := *chain[i]
+			indent := strings.Repeat("  ", len(chain)-1-i)
+			if indentCmdline {
+				row.cmdline = indent + row.cmdline
+			} else {
+				row.name = indent + row.name
+			}
+			rows = append(rows, &row)
+		}
+	}
+	return rows
+}
+
+func containsProcess(ps []*process, p *process) bool {
+	for _, q := range ps {
+		if q == p {
+			return true
+		}
+	}
+	return false
 }
 
 type filter struct {
 	name *regexp.Regexp
 	cmd  *regexp.Regexp
-	pid  int
-	ppid int
-	pgid int
+	base *regexp.Regexp
+	exe  *regexp.Regexp
+	pids map[int]bool // if non-nil, only include these pids
+	// users, if non-nil, holds the users given by -user. (Unlike user,
+	// below, this is a criterion like the others for -any and -v.)
+	users map[string]bool
+	ppid  int
+	pgid  int
+	env   []envMatcher
+
+	running    bool      // only include processes in state R
+	minFDs     int64     // if > 0, only include processes with more fds
+	minThreads int       // if > 0, only include processes with more threads
+	leaders    bool      // only include session or process group leaders
+	since      time.Time // if non-zero, only include processes started after this
+
+	// any means to include processes that match any of the criteria
+	// above rather than all of them.
+	any bool
+	// invert means to include exactly the processes that don't match.
+	invert bool
 
 	thisPID int    // don't include our own PID
-	user    string // only include this user
+	user    string // only include this user (the current one, without -all or -user)
 }
 
 func (f *filter) include(p *process) bool {
-	switch {
-	case f.thisPID == p.pid:
-		return false
-	case f.user != "" && f.user != p.user:
-		return false
-	case f.name != nil && !f.name.MatchString(p.name):
-		return false
-	case f.cmd != nil && !f.cmd.MatchString(p.cmdline):
-		return false
-	case f.pid != 0 && f.pid != p.pid:
-		return false
-	case f.ppid != 0 && f.ppid != p.ppid:
-		return false
-	case f.ppid != 0 && f.ppid != p.ppid:
-		return false
-	case f.pgid != 0 && f.pgid != p.pgid:
+	// These always apply, even with -any or -v.
+	if f.thisPID == p.tgid || (f.user != "" && f.user != p.user) {
 		return false
 	}
-	return true
+
+	var active, matched int
+	check := func(ok bool) {
+		active++
+		if ok {
+			matched++
+		}
+	}
+	if f.name != nil {
+		check(f.name.MatchString(p.name))
+	}
+	if f.cmd != nil {
+		check(f.cmd.MatchString(p.cmdline))
+	}
+	if f.base != nil {
+		check(f.base.MatchString(p.base))
+	}
+	if f.exe != nil {
+		check(p.exe != "" && p.exe != "?" && f.exe.MatchString(p.exe))
+	}
+	if f.pids != nil {
+		check(f.pids[p.tgid])
+	}
+	if f.users != nil {
+		check(f.users[p.user])
+	}
+	if f.ppid != 0 {
+		check(f.ppid == p.ppid)
+	}
+	if f.pgid != 0 {
+		check(f.pgid == p.pgid)
+	}
+	if f.running {
+		check(p.state == "R")
+	}
+	if f.minFDs > 0 {
+		check(p.nfds > f.minFDs) // also excludes unknown (-1) counts
+	}
+	if f.minThreads > 0 {
+		check(int(p.nthreads) > f.minThreads)
+	}
+	if f.leaders {
+		check(p.pid == p.sid || p.pid == p.pgid)
+	}
+	if !f.since.IsZero() {
+		check(p.start.After(f.since)) // unknown (zero) start times never match
+	}
+	for _, m := range f.env {
+		check(m.match(p.environ))
+	}
+	ok := matched == active
+	if f.any && active > 0 {
+		ok = matched > 0
+	}
+	return ok != f.invert
+}
+
+// An envMatcher matches processes that have an environment variable
+// called key whose value is equal to value (or matches re, if non-nil).
+type envMatcher struct {
+	key   string
+	value string
+	re    *regexp.Regexp
+}
+
+func (m envMatcher) match(environ []string) bool {
+	for _, kv := range environ {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 || kv[:i] != m.key {
+			continue
+		}
+		v := kv[i+1:]
+		if m.re != nil {
+			return m.re.MatchString(v)
+		}
+		return v == m.value
+	}
+	return false
 }
 
-type column uint
+func (m envMatcher) String() string {
+	if m.re != nil {
+		return m.key + "~" + m.re.String()
+	}
+	return m.key + "=" + m.value
+}
+
+type column uint64
 
 const (
 	colPID column = 1 << iota
+	colTGID
 	colPPID
 	colUser
 	colName
+	colState
 	colPGID
 	colRSS
 	colUptime
@@ -542,11 +1486,55 @@ const (
 	colCutime
 	colCstime
 	colCPUTime
+	colSelfCPU
 	colNThreads
+	colNTasks
 	colNFDs
+	colNSockets
+	colNFiles
 	colNChild
 	colNDesc
+	colSchedPolicy
+	colAffinity
+	colLastCPU
+	colGuestTime
+	colBlkioDelay
+	colRTPrio
+	colNMaps
+	colPSS
+	colUSS
+	colSwap
+	colText
+	colData
+	colPCPU
+	colStarted
+	colStartedISO
+	colPName
+	colDepth
+	colReparented
+	colArg0
+	colSID
+	colBase
+	colExe
+	colGroups
+	colRUID
+	colEUID
+	colLoginUID
+	colSeccomp
+	colCaps
+	colUmask
+	colSigPnd
+	colSigBlk
+	colSigIgn
+	colSigCgt
+	colContainer
+	colPIDNS
+	colNetNS
+	colMntNS
+	colNSPID
+	colPorts
 	colCmdline
+	colEnviron
 	numCols
 )
 
@@ -554,6 +1542,30 @@ type colConf struct {
 	name       string
 	desc       string
 	rightAlign bool
+	summable   bool // whether -total sums this column
+	// format, if non-nil, formats the column's value (in place of the
+	// default formatting in process.cells).
+	format func(interface{}) string
+	// unit is the unit of the column's raw value ("bytes" or, for
+	// durations, "s"), which -units adds to the header (see header).
+	unit string
+}
+
+// header returns the header of the column. If units is set, it appends the
+// unit of the column to the name if the values are printed as plain
+// numbers: sizes when raw is set (that is, for -tsv) and durations when raw
+// is set or durationUnit is nonzero.
+func (c colConf) header(units, raw bool, durationUnit time.Duration) string {
+	unit := c.unit
+	switch {
+	case !units || unit == "":
+		return c.name
+	case unit == "s" && durationUnit > 0:
+		unit = durationUnitFlag{&durationUnit}.String()
+	case !raw:
+		return c.name
+	}
+	return c.name + "(" + unit + ")"
 }
 
 var colConfs = map[column]colConf{
@@ -562,6 +1574,11 @@ var colConfs = map[column]colConf{
 		desc:       "Process ID",
 		rightAlign: true,
 	},
+	colTGID: {
+		name:       "tgid",
+		desc:       "Thread group ID (the pid of the process that owns a thread; see -threads)",
+		rightAlign: true,
+	},
 	colPPID: {
 		name:       "ppid",
 		desc:       "Parent process ID",
@@ -575,6 +1592,10 @@ var colConfs = map[column]colConf{
 		name: "name",
 		desc: "Name of the command (as reported by /proc/[pid]/stat)",
 	},
+	colState: {
+		name: "state",
+		desc: "Process state (R, S, D, Z, etc.; see -count-states)",
+	},
 	colPGID: {
 		name:       "pgid",
 		desc:       "Process group ID",
@@ -584,128 +1605,929 @@ var colConfs = map[column]colConf{
 		name:       "rss",
 		desc:       "Process resident set size (not including children)",
 		rightAlign: true,
+		summable:   true,
+		format:     formatBytesValue,
+		unit:       "bytes",
 	},
 	colUptime: {
 		name:       "uptime",
 		desc:       "How long the process has been running (wall time)",
 		rightAlign: true,
+		format:     formatUptimeValue,
+		unit:       "s",
 	},
 	colUtime: {
 		name:       "utime",
 		desc:       "Amount of time this process has been scheduled in user mode",
 		rightAlign: true,
+		summable:   true,
+		format:     formatDurationValue,
+		unit:       "s",
 	},
 	colStime: {
 		name:       "stime",
 		desc:       "Amount of time this process has been scheduled in kernel mode",
 		rightAlign: true,
+		summable:   true,
+		format:     formatDurationValue,
+		unit:       "s",
 	},
 	colCutime: {
 		name:       "cutime",
 		desc:       "Sum of utime for all descendents that were waited for and have exited",
 		rightAlign: true,
+		summable:   true,
+		format:     formatDurationValue,
+		unit:       "s",
 	},
 	colCstime: {
 		name:       "cstime",
 		desc:       "Sum of stime for all descendents that were waited for and have exited",
 		rightAlign: true,
+		summable:   true,
+		format:     formatDurationValue,
+		unit:       "s",
 	},
 	colCPUTime: {
 		name:       "cputime",
 		desc:       "Total CPU time as estimated by utime+stime+cutime+cstime",
 		rightAlign: true,
+		summable:   true,
+		format:     formatDurationValue,
+		unit:       "s",
+	},
+	colSelfCPU: {
+		name:       "selfcpu",
+		desc:       "CPU time of the process itself (utime+stime), not counting its children",
+		rightAlign: true,
+		summable:   true,
+		format:     formatDurationValue,
+		unit:       "s",
 	},
 	colNThreads: {
 		name:       "nthreads",
 		desc:       "Number of threads in the process",
 		rightAlign: true,
+		summable:   true,
+	},
+	colNTasks: {
+		name:       "ntasks",
+		desc:       "Number of threads, counted from /proc/[pid]/task (may briefly differ from nthreads)",
+		rightAlign: true,
+		format:     formatCountValue,
+	},
+	colNSockets: {
+		name:       "nsockets",
+		desc:       "Number of open sockets (file descriptors that refer to a socket)",
+		rightAlign: true,
+		summable:   true,
+		format:     formatCountValue,
+	},
+	colNFiles: {
+		name:       "nfiles",
+		desc:       "Number of open files (file descriptors that refer to a path, not a socket, pipe, etc.)",
+		rightAlign: true,
+		summable:   true,
+		format:     formatCountValue,
 	},
 	colNFDs: {
 		name:       "nfds",
 		desc:       "Number of open file descriptors",
 		rightAlign: true,
+		summable:   true,
+		format:     formatCountValue,
 	},
 	colNChild: {
 		name:       "nchild",
-		desc:       "Number of child processes",
+		desc:       "Number of child processes (threads aren't counted; see -threads)",
 		rightAlign: true,
+		format:     formatCountValue,
 	},
 	colNDesc: {
 		name:       "ndesc",
-		desc:       "Number of descendent processes",
+		desc:       "Number of descendent processes (threads aren't counted; see -threads)",
+		rightAlign: true,
+		format:     formatCountValue,
+	},
+	colSchedPolicy: {
+		name: "sched",
+		desc: "Scheduling policy (OTHER, FIFO, RR, BATCH, IDLE, or DEADLINE)",
+	},
+	colAffinity: {
+		name: "affinity",
+		desc: "CPUs the process may run on (its CPU affinity mask)",
+	},
+	colLastCPU: {
+		name:       "cpu",
+		desc:       "CPU the process last ran on",
+		rightAlign: true,
+	},
+	colGuestTime: {
+		name:       "guest",
+		desc:       "Amount of time spent running a virtual CPU for a guest operating system",
+		rightAlign: true,
+		summable:   true,
+		format:     formatDurationValue,
+		unit:       "s",
+	},
+	colBlkioDelay: {
+		name:       "blkio",
+		desc:       "Amount of time spent waiting for block I/O (requires delay accounting)",
+		rightAlign: true,
+		summable:   true,
+		format:     formatDurationValue,
+		unit:       "s",
+	},
+	colRTPrio: {
+		name:       "rtprio",
+		desc:       "Real-time scheduling priority (1-99 for FIFO and RR processes; 0 otherwise)",
+		rightAlign: true,
+	},
+	colNMaps: {
+		name:       "nmaps",
+		desc:       "Number of memory mappings (lines in /proc/[pid]/maps)",
 		rightAlign: true,
+		format:     formatCountValue,
+	},
+	colPSS: {
+		name:       "pss",
+		desc:       "Proportional set size (rss with shared pages divided among the sharing processes)",
+		rightAlign: true,
+		summable:   true,
+		format:     formatBytesValue,
+		unit:       "bytes",
+	},
+	colUSS: {
+		name:       "uss",
+		desc:       "Unique set size (memory that is private to the process)",
+		rightAlign: true,
+		summable:   true,
+		format:     formatBytesValue,
+		unit:       "bytes",
+	},
+	colSwap: {
+		name:       "swap",
+		desc:       "Amount of memory swapped out",
+		rightAlign: true,
+		summable:   true,
+		format:     formatBytesValue,
+		unit:       "bytes",
+	},
+	colText: {
+		name:       "text",
+		desc:       "Size of the program code (text segment)",
+		rightAlign: true,
+		summable:   true,
+		format:     formatBytesValue,
+		unit:       "bytes",
+	},
+	colData: {
+		name:       "data",
+		desc:       "Size of the data segment and stack",
+		rightAlign: true,
+		summable:   true,
+		format:     formatBytesValue,
+		unit:       "bytes",
+	},
+	colPCPU: {
+		name:       "pcpu",
+		desc:       "Average CPU usage (utime+stime) over the lifetime of the process, in percent (see -cpu-total)",
+		rightAlign: true,
+		summable:   true,
+		format:     formatPercentValue,
+	},
+	colStarted: {
+		name:   "started",
+		desc:   "When the process started (the time of day, if it was today)",
+		format: formatStartedValue,
+	},
+	colStartedISO: {
+		name: "started_iso",
+		desc: "When the process started, in RFC 3339 format (such as 2006-01-02T15:04:05-07:00)",
+	},
+	colPName: {
+		name: "pname",
+		desc: "Name of the parent process",
+	},
+	colDepth: {
+		name:       "depth",
+		desc:       "Number of ancestors (up to pid 1 or the first ancestor whose parent is unknown)",
+		rightAlign: true,
+	},
+	colReparented: {
+		name:   "reparented",
+		desc:   "Whether the parent is pid 1 (yes or no), as for a daemon or orphan reparented to init",
+		format: formatYesNoValue,
+	},
+	colArg0: {
+		name: "arg0",
+		desc: "First word of the command line (usually the program as invoked)",
+	},
+	colSID: {
+		name:       "sid",
+		desc:       "Session ID",
+		rightAlign: true,
+	},
+	colBase: {
+		name: "base",
+		desc: "Program name: the basename of arg0 (or [name] for kernel threads, which have no cmdline)",
+	},
+	colExe: {
+		name: "exe",
+		desc: "Path of the executable (from the /proc/[pid]/exe link)",
+	},
+	colGroups: {
+		name: "groups",
+		desc: "Supplementary group IDs (comma-separated)",
+	},
+	colRUID: {
+		name: "ruid",
+		desc: "Real user ID (as a username, if possible)",
+	},
+	colEUID: {
+		name: "euid",
+		desc: "Effective user ID (as a username, if possible)",
+	},
+	colLoginUID: {
+		name: "loginuid",
+		desc: "User who logged in to start the session containing the process, even across setuid (? if unset)",
+	},
+	colSeccomp: {
+		name: "seccomp",
+		desc: "Seccomp mode (none, strict, or filter)",
+	},
+	colCaps: {
+		name: "caps",
+		desc: "Effective capabilities (all, none, or a list such as cap_net_bind_service,cap_sys_admin)",
+	},
+	colUmask: {
+		name: "umask",
+		desc: "File mode creation mask (in octal)",
+	},
+	colSigPnd: {
+		name: "sigpnd",
+		desc: "Pending signals (for the thread or the whole process)",
+	},
+	colSigBlk: {
+		name: "sigblk",
+		desc: "Blocked signals",
+	},
+	colSigIgn: {
+		name: "sigign",
+		desc: "Ignored signals",
+	},
+	colSigCgt: {
+		name: "sigcgt",
+		desc: "Caught signals (those with a handler installed)",
+	},
+	colContainer: {
+		name: "container",
+		desc: "Short (12-character) ID of the Docker, containerd, CRI-O, or Podman container, from the cgroup path",
+	},
+	colPIDNS: {
+		name:       "pidns",
+		desc:       "Inode number of the PID namespace",
+		rightAlign: true,
+	},
+	colNetNS: {
+		name:       "netns",
+		desc:       "Inode number of the network namespace",
+		rightAlign: true,
+	},
+	colMntNS: {
+		name:       "mntns",
+		desc:       "Inode number of the mount namespace",
+		rightAlign: true,
+	},
+	colNSPID: {
+		name:       "nspid",
+		desc:       "Process ID as seen inside its own PID namespace (such as in a container)",
+		rightAlign: true,
+		format:     formatCountValue,
+	},
+	colPorts: {
+		name: "ports",
+		desc: "TCP and UDP ports the process is listening on (such as 22/tcp,53/udp; only in lp's network namespace; UDP includes unconnected clients)",
 	},
 	colCmdline: {
 		name: "cmdline",
 		desc: "Command line for the process",
 	},
+	colEnviron: {
+		name:   "environ",
+		desc:   "Environment of the process (space-separated KEY=VALUE pairs)",
+		format: formatListValue,
+	},
+}
+
+func printAllColumns() {
+	tb := tabular.New(tabular.Options{Padding: 2, PadChar: ' '})
+	for col := column(1); col < numCols; col <<= 1 {
+		cc := colConfs[col]
+		tb.AddRow("  "+cc.name, cc.desc)
+	}
+	tb.WriteTo(os.Stderr)
+}
+
+var colNames = make(map[string]column)
+
+func init() {
+	for col := column(1); col < numCols; col <<= 1 {
+		colNames[colConfs[col].name] = col
+	}
+}
+
+func (c column) String() string {
+	return colConfs[c].name
+}
+
+func (c column) has(col column) bool {
+	return c&col != 0
+}
+
+func (p *process) write(tw *tableWriter, cols column) {
+	cells := p.cells(cols, tw.durationUnit)
+	if tw.cmdWidth > 0 && cols.has(colCmdline) {
+		// The cmdline cell comes after one cell for each lower column.
+		i := bits.OnesCount64(uint64(cols & (colCmdline - 1)))
+		cells[i] = truncate(cells[i], tw.cmdWidth)
+	}
+	tw.append(cells)
+}
+
+// A columnValue is the value of one column for a process.
+type columnValue struct {
+	col column
+	v   interface{}
+}
+
+// values returns the values of all the columns for p, in column order.
+func (p *process) values() []columnValue {
+	return []columnValue{
+		{colPID, p.pid},
+		{colTGID, p.tgid},
+		{colPPID, p.ppid},
+		{colUser, p.user},
+		{colName, p.name},
+		{colState, p.state},
+		{colPGID, p.pgid},
+		{colRSS, p.rss},
+		{colUptime, p.uptime},
+		{colUtime, p.utime},
+		{colStime, p.stime},
+		{colCutime, p.cutime},
+		{colCstime, p.cstime},
+		{colCPUTime, p.cpuTime},
+		{colSelfCPU, p.selfCPU},
+		{colNThreads, p.nthreads},
+		{colNTasks, p.ntasks},
+		{colNFDs, p.nfds},
+		{colNSockets, p.nsockets},
+		{colNFiles, p.nfiles},
+		{colNChild, p.nchild},
+		{colNDesc, p.ndesc},
+		{colSchedPolicy, p.schedPolicy},
+		{colAffinity, p.affinity},
+		{colLastCPU, p.lastCPU},
+		{colGuestTime, p.guestTime},
+		{colBlkioDelay, p.blkioDelay},
+		{colRTPrio, p.rtPrio},
+		{colNMaps, p.nmaps},
+		{colPSS, p.pss},
+		{colUSS, p.uss},
+		{colSwap, p.swap},
+		{colText, p.text},
+		{colData, p.data},
+		{colPCPU, p.pcpu},
+		{colStarted, p.start},
+		{colStartedISO, rfc3339Time(p.start)},
+		{colPName, p.pname},
+		{colDepth, p.depth},
+		{colReparented, p.ppid == 1},
+		{colArg0, p.arg0},
+		{colSID, p.sid},
+		{colBase, p.base},
+		{colExe, p.exe},
+		{colGroups, p.groups},
+		{colRUID, p.ruid},
+		{colEUID, p.euid},
+		{colLoginUID, p.loginUID},
+		{colSeccomp, p.seccomp},
+		{colCaps, p.caps},
+		{colUmask, p.umask},
+		{colSigPnd, p.sigPnd},
+		{colSigBlk, p.sigBlk},
+		{colSigIgn, p.sigIgn},
+		{colSigCgt, p.sigCgt},
+		{colContainer, p.container},
+		{colPIDNS, p.pidNS},
+		{colNetNS, p.netNS},
+		{colMntNS, p.mntNS},
+		{colNSPID, p.nsPID},
+		{colPorts, p.ports},
+		{colCmdline, p.cmdline},
+		{colEnviron, p.environ},
+	}
+}
+
+// cells formats the values of the columns cols for p. If durationUnit is
+// nonzero, durations are written as a number of that unit.
+func (p *process) cells(cols column, durationUnit time.Duration) []string {
+	var cells []string
+	for _, cell := range p.values() {
+		if cols.has(cell.col) {
+			if d, ok := cell.v.(time.Duration); ok && durationUnit > 0 {
+				cells = append(cells, formatDurationUnit(d, durationUnit))
+				continue
+			}
+			if format := colConfs[cell.col].format; format != nil {
+				cells = append(cells, format(cell.v))
+			} else {
+				cells = append(cells, fmt.Sprint(cell.v))
+			}
+		}
+	}
+	return cells
+}
+
+// totalRows returns the footer rows for -total: a row containing the sums of
+// the summable columns over ps, with a label in the first non-summable
+// column. If every column is summable, the label gets a row of its own
+// before the sums so that they don't look like another process.
+func totalRows(ps []*process, cols column, durationUnit time.Duration) [][]string {
+	var t process
+	for _, p := range ps {
+		if p.rss > 0 { // skip unknown (-1) sizes
+			t.rss += p.rss
+		}
+		t.utime += p.utime
+		t.stime += p.stime
+		t.cutime += p.cutime
+		t.cstime += p.cstime
+		t.cpuTime += p.cpuTime
+		t.selfCPU += p.selfCPU
+		t.guestTime += p.guestTime
+		t.blkioDelay += p.blkioDelay
+		t.nthreads += p.nthreads
+		if p.nfds > 0 { // skip unknown (-1) counts
+			t.nfds += p.nfds
+		}
+		if p.nsockets > 0 {
+			t.nsockets += p.nsockets
+		}
+		if p.nfiles > 0 {
+			t.nfiles += p.nfiles
+		}
+		if p.pss > 0 {
+			t.pss += p.pss
+		}
+		if p.uss > 0 {
+			t.uss += p.uss
+		}
+		if p.swap > 0 {
+			t.swap += p.swap
+		}
+		t.text += p.text
+		t.data += p.data
+		t.pcpu += p.pcpu
+	}
+	cells := t.cells(cols, durationUnit)
+	labeled := false
+	i := 0
+	for col := column(1); col < numCols; col <<= 1 {
+		if !cols.has(col) {
+			continue
+		}
+		if !colConfs[col].summable {
+			if labeled {
+				cells[i] = ""
+			} else {
+				cells[i] = "TOTAL"
+				labeled = true
+			}
+		}
+		i++
+	}
+	if !labeled {
+		label := make([]string, len(cells))
+		label[0] = "TOTAL"
+		return [][]string{label, cells}
+	}
+	return [][]string{cells}
+}
+
+// userSummary aggregates ps by user into a table with a row per user,
+// ordered by decreasing total rss.
+func userSummary(ps []*process) *tableWriter {
+	type userTotal struct {
+		user    string
+		nproc   int
+		rss     bytesize
+		cpuTime time.Duration
+	}
+	byName := make(map[string]*userTotal)
+	var totals []*userTotal
+	for _, p := range ps {
+		ut, ok := byName[p.user]
+		if !ok {
+			ut = &userTotal{user: p.user}
+			byName[p.user] = ut
+			totals = append(totals, ut)
+		}
+		ut.nproc++
+		if p.rss > 0 {
+			ut.rss += p.rss
+		}
+		ut.cpuTime += p.cpuTime
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].rss != totals[j].rss {
+			return totals[i].rss > totals[j].rss
+		}
+		return totals[i].user < totals[j].user
+	})
+
+	tw := newTableWriterConfs([]colConf{
+		colConfs[colUser],
+		{name: "nproc", rightAlign: true},
+		colConfs[colRSS],
+		colConfs[colCPUTime],
+	}, true)
+	for _, ut := range totals {
+		tw.append([]string{
+			ut.user,
+			strconv.Itoa(ut.nproc),
+			ut.rss.String(),
+			formatDuration(ut.cpuTime),
+		})
+	}
+	return tw
+}
+
+// stateDescs describes the process states reported in /proc/[pid]/stat.
+var stateDescs = map[string]string{
+	"R": "running",
+	"S": "sleeping",
+	"D": "uninterruptible disk sleep",
+	"Z": "zombie",
+	"T": "stopped",
+	"t": "tracing stop",
+	"X": "dead",
+	"I": "idle",
+	"P": "parked",
+	"W": "waking",
+	"K": "wakekill",
+	"L": "waiting to acquire a lock",
+}
+
+// stateSummary counts ps by state into a table with a row per state,
+// ordered by decreasing count.
+func stateSummary(ps []*process) *tableWriter {
+	counts := make(map[string]int)
+	var states []string
+	for _, p := range ps {
+		if _, ok := counts[p.state]; !ok {
+			states = append(states, p.state)
+		}
+		counts[p.state]++
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if counts[states[i]] != counts[states[j]] {
+			return counts[states[i]] > counts[states[j]]
+		}
+		return states[i] < states[j]
+	})
+
+	tw := newTableWriterConfs([]colConf{
+		colConfs[colState],
+		{name: "nproc", rightAlign: true},
+		{name: "desc"},
+	}, true)
+	for _, state := range states {
+		tw.append([]string{state, strconv.Itoa(counts[state]), stateDescs[state]})
+	}
+	return tw
+}
+
+// writeDOT writes the hierarchy of ps as a Graphviz digraph with an edge
+// from each process to each of its children. The parents of processes in
+// ps are included (drawn dashed) even if they aren't in ps themselves.
+func writeDOT(w io.Writer, ps []*process) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph processes {")
+	included := make(map[*process]bool)
+	for _, p := range ps {
+		included[p] = true
+	}
+	for _, p := range ps {
+		fmt.Fprintf(bw, "\t%d [label=%s];\n", p.pid, dotQuote(p))
+	}
+	extra := make(map[*process]bool)
+	for _, p := range ps {
+		if p.parent != nil && !included[p.parent] && !extra[p.parent] {
+			extra[p.parent] = true
+			fmt.Fprintf(bw, "\t%d [label=%s, style=dashed];\n", p.parent.pid, dotQuote(p.parent))
+		}
+	}
+	for _, p := range ps {
+		if p.parent != nil {
+			fmt.Fprintf(bw, "\t%d -> %d;\n", p.parent.pid, p.pid)
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// dotQuote returns the DOT label for p as a quoted string.
+func dotQuote(p *process) string {
+	label := strconv.Itoa(p.pid) + " " + p.name
+	label = strings.ReplaceAll(label, `\`, `\\`)
+	label = strings.ReplaceAll(label, `"`, `\"`)
+	return `"` + label + `"`
+}
+
+// templateNames are the -format field names of the columns that aren't
+// just capitalized column names.
+var templateNames = map[column]string{
+	colPID:        "PID",
+	colTGID:       "TGID",
+	colPPID:       "PPID",
+	colPGID:       "PGID",
+	colRSS:        "RSS",
+	colCPUTime:    "CPUTime",
+	colSelfCPU:    "SelfCPU",
+	colNThreads:   "NThreads",
+	colNTasks:     "NTasks",
+	colNFDs:       "NFDs",
+	colNSockets:   "NSockets",
+	colNFiles:     "NFiles",
+	colNChild:     "NChild",
+	colNDesc:      "NDesc",
+	colLastCPU:    "CPU",
+	colRTPrio:     "RTPrio",
+	colNMaps:      "NMaps",
+	colPSS:        "PSS",
+	colUSS:        "USS",
+	colPCPU:       "PCPU",
+	colPName:      "PName",
+	colStartedISO: "StartedISO",
+	colSID:        "SID",
+	colRUID:       "RUID",
+	colEUID:       "EUID",
+	colLoginUID:   "LoginUID",
+	colSigPnd:     "SigPnd",
+	colSigBlk:     "SigBlk",
+	colSigIgn:     "SigIgn",
+	colSigCgt:     "SigCgt",
+	colPIDNS:      "PIDNS",
+	colNetNS:      "NetNS",
+	colMntNS:      "MntNS",
+	colNSPID:      "NSPID",
+}
+
+// templateName returns the -format field name for col.
+func templateName(col column) string {
+	if name, ok := templateNames[col]; ok {
+		return name
+	}
+	name := colConfs[col].name
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+var templateFuncs = template.FuncMap{
+	"bytes": func(v interface{}) (string, error) {
+		n, err := templateInt(v)
+		return bytesize(n).String(), err
+	},
+	"duration": func(v interface{}) (string, error) {
+		n, err := templateInt(v)
+		return formatDuration(time.Duration(n)), err
+	},
+	"join": func(sep string, v interface{}) (string, error) {
+		switch ss := v.(type) {
+		case formattedList:
+			return strings.Join(ss, sep), nil
+		case []string:
+			return strings.Join(ss, sep), nil
+		}
+		return "", fmt.Errorf("expected a list; got %T", v)
+	},
 }
 
-func printAllColumns() {
-	tb := tabular.New(tabular.Options{Padding: 2, PadChar: ' '})
-	for col := column(1); col < numCols; col <<= 1 {
-		cc := colConfs[col]
-		tb.AddRow("  "+cc.name, cc.desc)
+// templateInt converts the integer argument of a template function (which
+// may be a literal, a size or duration field, and so on) to an int64.
+func templateInt(v interface{}) (int64, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
 	}
-	tb.WriteTo(os.Stderr)
+	return 0, fmt.Errorf("expected an integer; got %T", v)
 }
 
-var colNames = make(map[string]column)
+// templateFieldRE matches the field references in a -format template.
+var templateFieldRE = regexp.MustCompile(`\.([A-Za-z][A-Za-z0-9]*)`)
 
-func init() {
+// parseFormat parses a -format template. It also returns the columns that
+// the template (probably) uses: it's not worth walking the template parse
+// tree to find the fields, so any .Name in the template counts.
+func parseFormat(format string) (*template.Template, column, error) {
+	tmpl, err := template.New("format").Funcs(templateFuncs).Option("missingkey=error").Parse(format)
+	if err != nil {
+		return nil, 0, err
+	}
+	byName := make(map[string]column)
 	for col := column(1); col < numCols; col <<= 1 {
-		colNames[colConfs[col].name] = col
+		byName[templateName(col)] = col
 	}
+	var cols column
+	for _, m := range templateFieldRE.FindAllStringSubmatch(format, -1) {
+		cols |= byName[m[1]]
+	}
+	return tmpl, cols, nil
 }
 
-func (c column) String() string {
-	return colConfs[c].name
+// writeFormatted writes each process in ps to w using tmpl.
+func writeFormatted(w io.Writer, tmpl *template.Template, ps []*process) error {
+	bw := bufio.NewWriter(w)
+	fields := make(map[string]interface{})
+	for _, p := range ps {
+		for _, cv := range p.values() {
+			fields[templateName(cv.col)] = templateValue(cv)
+		}
+		if err := tmpl.Execute(bw, fields); err != nil {
+			return err
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
 }
 
-func (c column) has(col column) bool {
-	return c&col != 0
+// writeTSV writes a header (with units, if units is set) and then one line
+// per process in ps to w, as tab-separated values, for -tsv. Unlike the
+// table, sizes are written in bytes and durations as a number of seconds (or
+// of durationUnit, if nonzero), and tabs and newlines inside values are
+// replaced by spaces so that each process is exactly one line.
+func writeTSV(w io.Writer, cols column, ps []*process, durationUnit time.Duration, units bool) error {
+	if durationUnit == 0 {
+		durationUnit = time.Second
+	}
+	bw := bufio.NewWriter(w)
+	var row []string
+	for _, conf := range colConfsFor(cols) {
+		row = append(row, conf.header(units, true, durationUnit))
+	}
+	bw.WriteString(strings.Join(row, "\t"))
+	bw.WriteByte('\n')
+	for _, p := range ps {
+		row = row[:0]
+		for _, cv := range p.values() {
+			if cols.has(cv.col) {
+				row = append(row, tsvEscaper.Replace(tsvCell(cv, durationUnit)))
+			}
+		}
+		bw.WriteString(strings.Join(row, "\t"))
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
 }
 
-func (p *process) write(tw *tableWriter, cols column) {
-	var cells []string
-	for _, cell := range []struct {
-		col column
-		v   interface{}
-	}{
-		{colPID, p.pid},
-		{colPPID, p.ppid},
-		{colUser, p.user},
-		{colName, p.name},
-		{colPGID, p.pgid},
-		{colRSS, p.rss},
-		{colUptime, p.uptime},
-		{colUtime, p.utime},
-		{colStime, p.stime},
-		{colCutime, p.cutime},
-		{colCstime, p.cstime},
-		{colCPUTime, p.cpuTime},
-		{colNThreads, p.nthreads},
-		{colNFDs, p.nfds},
-		{colNChild, p.nchild},
-		{colNDesc, p.ndesc},
-		{colCmdline, p.cmdline},
-	} {
-		if cols.has(cell.col) {
-			switch v := cell.v.(type) {
-			case time.Duration:
-				cells = append(cells, formatDuration(v))
-			case int64:
-				if v == -1 {
-					cells = append(cells, "?")
-				} else {
-					cells = append(cells, strconv.FormatInt(v, 10))
-				}
-			default:
-				cells = append(cells, fmt.Sprint(cell.v))
-			}
+var tsvEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// tsvCell formats cv for writeTSV.
+func tsvCell(cv columnValue, durationUnit time.Duration) string {
+	switch v := cv.v.(type) {
+	case bytesize:
+		return strconv.FormatInt(int64(v), 10)
+	case time.Duration:
+		return formatDurationUnit(v, durationUnit)
+	case time.Time:
+		return rfc3339Time(v).String()
+	}
+	if format := colConfs[cv.col].format; format != nil {
+		return format(cv.v)
+	}
+	return fmt.Sprint(cv.v)
+}
+
+// templateValue converts cv to the value of its -format field. Values that
+// the table formats specially are given types whose String method prints
+// them in the same way; since the types have the same underlying types as
+// the values, the fields may still be compared (such as with gt) and passed
+// to the template functions.
+func templateValue(cv columnValue) interface{} {
+	switch v := cv.v.(type) {
+	case time.Duration:
+		if cv.col == colUptime {
+			return formattedUptime(v)
 		}
+		return formattedDuration(v)
+	case time.Time:
+		return formattedTime(v)
+	case int64:
+		return formattedCount(v)
+	case bool:
+		return formattedYesNo(v)
+	case []string:
+		return formattedList(v)
 	}
-	tw.append(cells)
+	return cv.v
+}
+
+// These are the -format field types for templateValue.
+
+type formattedDuration time.Duration
+type formattedUptime time.Duration
+type formattedTime time.Time
+type formattedCount int64
+type formattedYesNo bool
+type formattedList []string
+
+func (d formattedDuration) String() string { return formatDurationValue(time.Duration(d)) }
+func (d formattedUptime) String() string   { return formatUptimeValue(time.Duration(d)) }
+func (t formattedTime) String() string     { return formatStartedValue(time.Time(t)) }
+func (n formattedCount) String() string    { return formatCountValue(int64(n)) }
+func (b formattedYesNo) String() string    { return formatYesNoValue(bool(b)) }
+func (l formattedList) String() string     { return formatListValue([]string(l)) }
+
+// summaryLine returns a one-line summary of ps for -summary, such as
+// "247 processes, 12 running, 3 zombie, 18.2 GB rss".
+func summaryLine(ps []*process) string {
+	var running, zombie int
+	var rss bytesize
+	for _, p := range ps {
+		switch p.state {
+		case "R":
+			running++
+		case "Z":
+			zombie++
+		}
+		if p.rss > 0 {
+			rss += p.rss
+		}
+	}
+	noun := "processes"
+	if len(ps) == 1 {
+		noun = "process"
+	}
+	return fmt.Sprintf("%d %s, %d running, %d zombie, %s rss", len(ps), noun, running, zombie, rss)
+}
+
+// memSummary totals the memory usage of ps into a single-row table. It
+// also returns the number of processes whose rss or pss and uss are unknown
+// (and therefore omitted from the totals).
+func memSummary(ps []*process) (tw *tableWriter, unknown int) {
+	var rss, pss, uss bytesize
+	for _, p := range ps {
+		if p.rss > 0 {
+			rss += p.rss
+		}
+		if p.rss < 0 || p.pss < 0 {
+			unknown++
+			continue
+		}
+		pss += p.pss
+		uss += p.uss
+	}
+	tw = newTableWriterConfs([]colConf{
+		{name: "nproc", rightAlign: true},
+		colConfs[colRSS],
+		colConfs[colPSS],
+		colConfs[colUSS],
+	}, true)
+	tw.append([]string{strconv.Itoa(len(ps)), rss.String(), pss.String(), uss.String()})
+	return tw, unknown
+}
+
+// uniqSummary counts the distinct values of the column col over ps into a
+// table ordered by decreasing count.
+func uniqSummary(ps []*process, col column) *tableWriter {
+	counts := make(map[string]int)
+	var values []string
+	for _, p := range ps {
+		v := p.cells(col, 0)[0]
+		if _, ok := counts[v]; !ok {
+			values = append(values, v)
+		}
+		counts[v]++
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+
+	tw := newTableWriterConfs([]colConf{
+		{name: "count", rightAlign: true},
+		colConfs[col],
+	}, true)
+	for _, v := range values {
+		tw.append([]string{strconv.Itoa(counts[v]), v})
+	}
+	return tw
 }
 
 type columnOpts uint
@@ -716,27 +2538,49 @@ const (
 
 type tableWriter struct {
 	termWidth int
+	wide      bool // never trim lines to termWidth
+	sep       string
 	opts      []columnOpts
 	widths    []int
 	cells     [][]string
+	colors    []string // ANSI SGR sequence for each row in cells, or ""
+	footer    [][]string
+
+	durationUnit time.Duration // see process.cells
+	maxColWidth  int           // if > 0, truncate longer cells (see append)
+	cmdWidth     int           // if > 0, truncate longer cmdlines (see process.write)
 }
 
 func newTableWriter(cols column, includeHeaders bool) *tableWriter {
-	n := bits.OnesCount(uint(cols))
+	return newTableWriterConfs(colConfsFor(cols), includeHeaders)
+}
+
+// colConfsFor returns the colConfs of cols, in display order.
+func colConfsFor(cols column) []colConf {
+	confs := make([]colConf, 0, bits.OnesCount64(uint64(cols)))
+	for col := column(1); col < numCols; col <<= 1 {
+		if cols.has(col) {
+			confs = append(confs, colConfs[col])
+		}
+	}
+	return confs
+}
+
+// newTableWriterConfs creates a tableWriter with arbitrary columns (which
+// need not correspond to process columns).
+func newTableWriterConfs(confs []colConf, includeHeaders bool) *tableWriter {
+	n := len(confs)
 	tw := &tableWriter{
 		termWidth: termWidth(),
+		sep:       defaultSep,
 		opts:      make([]columnOpts, n),
 		widths:    make([]int, n),
 	}
 	if includeHeaders {
 		tw.cells = append(tw.cells, make([]string, n))
+		tw.colors = append(tw.colors, "")
 	}
-	i := 0
-	for col := column(1); col < numCols; col <<= 1 {
-		if !cols.has(col) {
-			continue
-		}
-		cc := colConfs[col]
+	for i, cc := range confs {
 		var opts columnOpts
 		if cc.rightAlign {
 			opts |= rightAlign
@@ -746,7 +2590,6 @@ func newTableWriter(cols column, includeHeaders bool) *tableWriter {
 		if includeHeaders {
 			tw.cells[0][i] = cc.name
 		}
-		i++
 	}
 	return tw
 }
@@ -756,27 +2599,87 @@ func (tw *tableWriter) append(cells []string) {
 		panic("tableWriter.append called with unexpected number of columns")
 	}
 	for i, cell := range cells {
+		if tw.maxColWidth > 0 {
+			cell = truncate(cell, tw.maxColWidth)
+			cells[i] = cell
+		}
 		if len(cell) > tw.widths[i] {
 			tw.widths[i] = len(cell)
 		}
 	}
 	tw.cells = append(tw.cells, cells)
+	tw.colors = append(tw.colors, "")
 }
 
-const pad = "  "
+// truncate shortens s to n characters (runes), ending with "..." if there's
+// room. It never splits a multi-byte character.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	keep := n
+	if n > 3 {
+		keep = n - 3
+	}
+	i := 0
+	for keep > 0 {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		keep--
+	}
+	if n <= 3 {
+		return s[:i]
+	}
+	return s[:i] + "..."
+}
+
+// setColor sets the color of the last row to be appended using an ANSI SGR
+// sequence such as ansiRed. The color doesn't count toward the width.
+func (tw *tableWriter) setColor(color string) {
+	tw.colors[len(tw.colors)-1] = color
+}
+
+// appendFooter sets footer rows which are written after all the other rows,
+// set off from them by a horizontal rule.
+func (tw *tableWriter) appendFooter(rows ...[]string) {
+	for _, cells := range rows {
+		tw.append(cells)
+		tw.footer = append(tw.footer, tw.cells[len(tw.cells)-1])
+		tw.cells = tw.cells[:len(tw.cells)-1]
+		tw.colors = tw.colors[:len(tw.colors)-1]
+	}
+}
+
+// defaultSep is the column separator (in addition to the padding used to
+// align the columns).
+const defaultSep = "  "
 
 func (tw *tableWriter) write(w io.Writer) {
 	bw := bufio.NewWriter(w)
 	defer bw.Flush()
+	rows := tw.cells
+	if tw.footer != nil {
+		rule := make([]string, len(tw.widths))
+		for j, w := range tw.widths {
+			rule[j] = strings.Repeat("-", w)
+		}
+		rows = append(rows[:len(rows):len(rows)], rule)
+		rows = append(rows, tw.footer...)
+	}
+	// With tab-separated columns, alignment is left to the reader.
+	align := !strings.Contains(tw.sep, "\t")
 	trim := false
 	var b []byte
-	for i, row := range tw.cells {
+	for i, row := range rows {
 		b = b[:0]
 		for j, cell := range row {
 			if j > 0 {
-				b = append(b, pad...)
+				b = append(b, tw.sep...)
 			}
 			w := tw.widths[j]
+			if !align {
+				w = 0
+			}
 			if tw.opts[j]&rightAlign != 0 {
 				for k := len(cell); k < w; k++ {
 					b = append(b, ' ')
@@ -800,43 +2703,456 @@ func (tw *tableWriter) write(w io.Writer) {
 		// trimmed output will probably be too confusing if it doesn't
 		// include the requested columns.
 		if i == 0 {
-			trim = tw.termWidth > 3 && len(b) < tw.termWidth
+			trim = !tw.wide && tw.termWidth > 3 && len(b) < tw.termWidth
 		}
 		if trim && len(b) > tw.termWidth {
 			b = b[:tw.termWidth-3]
 			b = append(b, "..."...)
 		}
+		if i < len(tw.colors) && tw.colors[i] != "" {
+			bw.WriteString(tw.colors[i])
+			b = append(b, ansiReset...)
+		}
 		b = append(b, '\n')
 		bw.Write(b)
 	}
 }
 
-type reFlag struct {
-	p **regexp.Regexp
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+	ansiCyan   = "\x1b[36m"
+)
+
+// highCPU is the fraction of its lifetime that a process must have spent
+// on a CPU (not counting its children) in order to be colored as a CPU hog.
+const highCPU = 0.5
+
+// color returns the color for p's row in colorized output: red for
+// zombies, yellow for processes that use a lot of CPU, and cyan for
+// processes belonging to currentUser (if it's not empty).
+func (p *process) color(currentUser string) string {
+	switch {
+	case p.state == "Z":
+		return ansiRed
+	case p.uptime > 0 && float64(p.selfCPU) >= highCPU*float64(p.uptime):
+		return ansiYellow
+	case currentUser != "" && p.user == currentUser:
+		return ansiCyan
+	}
+	return ""
+}
+
+// maxRSS returns the index of the process in ps with the largest rss, or
+// -1 if none of them has any resident memory.
+func maxRSS(ps []*process) int {
+	idx := -1
+	var max bytesize
+	for i, p := range ps {
+		if p.rss > max {
+			idx = i
+			max = p.rss
+		}
+	}
+	return idx
+}
+
+// compilePattern compiles a -name, -cmd, -base, or -exe pattern, which is
+// either a regular expression or (if glob is set) a shell glob. It returns nil
+// if the pattern is empty.
+func compilePattern(pattern string, glob bool) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	if glob {
+		pattern = globToRegexp(pattern)
+	}
+	return regexp.Compile(pattern)
+}
+
+// globToRegexp translates a shell glob into an equivalent anchored regular
+// expression. The glob syntax is that of path.Match except that * and ?
+// also match slashes.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case '[':
+			j := strings.IndexByte(glob[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+j]
+			i += j + 1
+			b.WriteByte('[')
+			if strings.HasPrefix(class, "^") || strings.HasPrefix(class, "!") {
+				b.WriteByte('^')
+				class = class[1:]
+			}
+			b.WriteString(strings.NewReplacer(`\`, `\\`, "[", `\[`).Replace(class))
+			b.WriteByte(']')
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// usersFlag is a flag.Value for a set of comma-separated usernames.
+type usersFlag struct {
+	p *map[string]bool
+}
+
+func (f usersFlag) Set(s string) error {
+	if *f.p == nil {
+		*f.p = make(map[string]bool)
+	}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return errors.New("empty username")
+		}
+		(*f.p)[name] = true
+	}
+	return nil
+}
+
+func (f usersFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	var names []string
+	for name := range *f.p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// pidsFlag is a flag.Value for a set of comma-separated PIDs.
+type pidsFlag struct {
+	p *map[int]bool
+}
+
+func (f pidsFlag) Set(s string) error {
+	for _, field := range strings.Split(s, ",") {
+		if err := addPID(f.p, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f pidsFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	var pids []int
+	for pid := range *f.p {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	var ss []string
+	for _, pid := range pids {
+		ss = append(ss, strconv.Itoa(pid))
+	}
+	return strings.Join(ss, ",")
 }
 
-func (f reFlag) Set(s string) error {
-	re, err := regexp.Compile(s)
+// readPIDs adds the PIDs listed one per line in r to pids. (Blank lines are
+// ignored.) The set is created, even if it remains empty.
+func readPIDs(r io.Reader, pids *map[int]bool) error {
+	if *pids == nil {
+		*pids = make(map[int]bool)
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := addPID(pids, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func addPID(pids *map[int]bool, s string) error {
+	pid, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("invalid PID %q", s)
+	}
+	if *pids == nil {
+		*pids = make(map[int]bool)
+	}
+	(*pids)[pid] = true
+	return nil
+}
+
+// sinceFlag is a flag.Value for the -since time.
+type sinceFlag struct {
+	p *time.Time
+}
+
+func (f sinceFlag) Set(s string) error {
+	t, err := parseSince(s, time.Now())
 	if err != nil {
 		return err
 	}
-	*f.p = re
+	*f.p = t
+	return nil
+}
+
+func (f sinceFlag) String() string {
+	if f.p == nil || f.p.IsZero() {
+		return ""
+	}
+	return f.p.Format(time.RFC3339)
+}
+
+// parseSince parses a -since time, which may be an RFC 3339 timestamp, a
+// time of day (today, in the local time zone), or a duration before now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			y, m, d := now.Date()
+			return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, now.Location()), nil
+		}
+	}
+	if d, err := time.ParseDuration(strings.TrimPrefix(s, "-")); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (want an RFC 3339 timestamp, 15:04, or a duration such as 1h)", s)
+}
+
+// durationUnits are the units accepted by -duration-unit.
+var durationUnits = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// durationUnitFlag is a flag.Value for a duration unit given by name.
+type durationUnitFlag struct {
+	p *time.Duration
+}
+
+func (f durationUnitFlag) Set(s string) error {
+	unit, ok := durationUnits[s]
+	if !ok {
+		return fmt.Errorf("unknown duration unit %q (want s, ms, us, or ns)", s)
+	}
+	*f.p = unit
 	return nil
 }
 
-func (f reFlag) String() string {
-	if f.p == nil || *f.p == nil {
+func (f durationUnitFlag) String() string {
+	if f.p != nil {
+		for name, unit := range durationUnits {
+			if unit == *f.p {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// signalFlag is a flag.Value for a signal given by name (with or without
+// the SIG prefix) or by number.
+type signalFlag struct {
+	p *syscall.Signal
+}
+
+func (f signalFlag) Set(s string) error {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 {
+			return fmt.Errorf("invalid signal number %d", n)
+		}
+		*f.p = syscall.Signal(n)
+		return nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return fmt.Errorf("unknown signal %q", s)
+	}
+	*f.p = sig
+	return nil
+}
+
+func (f signalFlag) String() string {
+	if f.p == nil || *f.p == 0 {
+		return ""
+	}
+	return unix.SignalName(*f.p)
+}
+
+type envFlag struct {
+	p *[]envMatcher
+}
+
+func (f envFlag) Set(s string) error {
+	i := strings.IndexAny(s, "=~")
+	if i <= 0 {
+		return errors.New("must be of the form KEY=VALUE or KEY~REGEX")
+	}
+	m := envMatcher{key: s[:i]}
+	if s[i] == '~' {
+		re, err := regexp.Compile(s[i+1:])
+		if err != nil {
+			return err
+		}
+		m.re = re
+	} else {
+		m.value = s[i+1:]
+	}
+	*f.p = append(*f.p, m)
+	return nil
+}
+
+func (f envFlag) String() string {
+	if f.p == nil {
 		return ""
 	}
-	return (*f.p).String()
+	var ss []string
+	for _, m := range *f.p {
+		ss = append(ss, m.String())
+	}
+	return strings.Join(ss, " ")
 }
 
 type bytesize int64
 
+// iecBytes makes bytesize use binary (base-1024) units such as MiB rather
+// than SI units such as MB. It is set by -iec.
+var iecBytes bool
+
 func (b bytesize) String() string {
+	if b < 0 {
+		return "?"
+	}
+	if iecBytes {
+		return humanize.IBytes(uint64(b))
+	}
 	return humanize.Bytes(uint64(b))
 }
 
+type percent float64
+
+func (p percent) String() string {
+	return strconv.FormatFloat(float64(p), 'f', 1, 64)
+}
+
+// formatStart formats a process start time t as the time of day if it's
+// the same day as now and as the date and time otherwise.
+func formatStart(t, now time.Time) string {
+	if t.IsZero() {
+		return "?"
+	}
+	if y, m, d := t.Date(); y == now.Year() && m == now.Month() && d == now.Day() {
+		return t.Format("15:04:05")
+	}
+	return t.Format("Jan 02 15:04")
+}
+
+// rfc3339Time is a time.Time that is formatted according to RFC 3339.
+type rfc3339Time time.Time
+
+func (t rfc3339Time) String() string {
+	if time.Time(t).IsZero() {
+		return "?"
+	}
+	return time.Time(t).Format(time.RFC3339)
+}
+
+// formatDurationUnit formats d (which must not be negative) as a decimal
+// number of unit, which must be a power of ten nanoseconds, without any
+// rounding.
+func formatDurationUnit(d, unit time.Duration) string {
+	s := strconv.FormatInt(int64(d/unit), 10)
+	frac := d % unit
+	if frac == 0 {
+		return s
+	}
+	digits := len(strconv.FormatInt(int64(unit), 10)) - 1
+	fs := strconv.FormatInt(int64(frac), 10)
+	fs = strings.Repeat("0", digits-len(fs)) + fs
+	return s + "." + strings.TrimRight(fs, "0")
+}
+
+// These are the formatting functions for colConf.format. Columns without
+// one (such as strings and IDs) are formatted with fmt.Sprint.
+
+func formatBytesValue(v interface{}) string    { return v.(bytesize).String() }
+func formatDurationValue(v interface{}) string { return formatDuration(v.(time.Duration)) }
+func formatUptimeValue(v interface{}) string   { return formatUptime(v.(time.Duration)) }
+func formatPercentValue(v interface{}) string  { return v.(percent).String() }
+
+func formatYesNoValue(v interface{}) string {
+	if v.(bool) {
+		return "yes"
+	}
+	return "no"
+}
+
+// formatCountValue formats an int64 count, which is -1 if unknown.
+func formatCountValue(v interface{}) string {
+	if n := v.(int64); n >= 0 {
+		return strconv.FormatInt(n, 10)
+	}
+	return "?"
+}
+
+func formatStartedValue(v interface{}) string {
+	return formatStart(v.(time.Time), time.Now())
+}
+
+// formatListValue formats a []string, which is nil if unknown.
+func formatListValue(v interface{}) string {
+	ss := v.([]string)
+	if ss == nil {
+		return "?"
+	}
+	return strings.Join(ss, " ")
+}
+
+// formatUptime is like formatDuration except that durations of 48 hours or
+// more are given in days and hours (such as 14d3h) rather than just hours.
+func formatUptime(d time.Duration) string {
+	if d < 48*time.Hour {
+		return formatDuration(d)
+	}
+	d = d.Round(time.Hour)
+	days := d / (24 * time.Hour)
+	hours := (d % (24 * time.Hour)) / time.Hour
+	if hours == 0 {
+		return fmt.Sprintf("%dd", days)
+	}
+	return fmt.Sprintf("%dd%dh", days, hours)
+}
+
 func formatDuration(d time.Duration) string {
 	var m time.Duration
 	switch {
@@ -866,10 +3182,6 @@ func formatDuration(d time.Duration) string {
 		m = time.Hour
 	}
 
-	// TODO: For uptime specifically, displaying "12345h" is probably not
-	// as useful as displaying a date. But getting a readable, compact
-	// display is tricky.
-
 	s := d.Round(m).String()
 	if m > time.Second {
 		s = strings.TrimSuffix(s, "0s")
@@ -2,47 +2,191 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/go-cmp/cmp"
 )
 
-func TestListerParseStat(t *testing.T) {
-	dir := t.TempDir()
-	const contents = `1860 (panel-6-indicat) S 1837 1689 1689 0 -1 4194304 2673 34 2 0 77 38 5 7 20 0 3 0 1971 440897536 6029 18446744073709551615 94731670310912 94731670333832 140730895617600 0 0 0 0 4096 0 0 0 0 17 0 0 0 0 0 0 94731672435056 94731672436756 94731700363264 140730895620536 140730895620840 140730895620840 140730895622086 0`
-	statPath := filepath.Join(dir, "stat")
-	if err := ioutil.WriteFile(statPath, []byte(contents), 0o755); err != nil {
+func TestParsePasswd(t *testing.T) {
+	const passwd = `root:x:0:0:root:/root:/bin/bash
+# A comment.
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+
+toor:x:0:0:another root:/root:/bin/sh
+malformed
+nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin
+bad:x:notanumber:0::/:/bin/sh
+`
+	got, err := parsePasswd(strings.NewReader(passwd))
+	if err != nil {
 		t.Fatal(err)
 	}
+	want := map[uint32]string{
+		0:     "root",
+		1:     "daemon",
+		65534: "nobody",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("parsePasswd gave incorrect output (-got,+want):\n%s", diff)
+	}
+}
 
-	l := newLister(nil, 0)
-	l.clockTick = 10 * time.Millisecond
-	l.pageSize = 4096
-	l.uptime = 10 * time.Minute
-	p := new(process)
-	if err := l.parseStat(p, statPath); err != nil {
-		t.Fatalf("parseStat: %s", err)
+func BenchmarkGetUser(b *testing.B) {
+	users, err := readPasswd("/etc/passwd")
+	if err != nil {
+		b.Skip(err)
+	}
+	var uids []uint32
+	for uid := range users {
+		uids = append(uids, uid)
+	}
+	for _, bb := range []struct {
+		name     string
+		needCols column
+	}{
+		{"passwd", colUser},
+		{"lookup", 0}, // don't prime the cache from /etc/passwd
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				l := newLister(nil, bb.needCols)
+				for _, uid := range uids {
+					l.getUser(uid)
+				}
+			}
+		})
 	}
+}
 
-	want := &process{
-		name:     "panel-6-indicat",
-		ppid:     1837,
-		pgid:     1689,
-		rss:      24694784,
-		uptime:   9*time.Minute + 40*time.Second + 290*time.Millisecond,
-		nthreads: 3,
-		utime:    770 * time.Millisecond,
-		stime:    380 * time.Millisecond,
-		cutime:   50 * time.Millisecond,
-		cstime:   70 * time.Millisecond,
-		cpuTime:  1270 * time.Millisecond,
+func TestFilterEnv(t *testing.T) {
+	var f filter
+	for _, s := range []string{"DEBUG=1", "HOME~^/home/"} {
+		if err := (envFlag{&f.env}).Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		environ []string
+		want    bool
+	}{
+		{nil, false},
+		{[]string{}, false},
+		{[]string{"DEBUG=1", "HOME=/home/alice"}, true},
+		{[]string{"HOME=/home/alice", "X=", "DEBUG=1"}, true},
+		{[]string{"DEBUG=10", "HOME=/home/alice"}, false},
+		{[]string{"DEBUG=1", "HOME=/root"}, false},
+		{[]string{"DEBUG=1"}, false},
+	} {
+		p := &process{pid: 1, tgid: 1, environ: tt.environ}
+		if got := f.include(p); got != tt.want {
+			t.Errorf("include(environ=%q): got %t; want %t", tt.environ, got, tt.want)
+		}
 	}
+}
 
-	if diff := cmp.Diff(p, want, cmp.AllowUnexported(process{})); diff != "" {
-		t.Errorf("parseStat gave incorrect output (-got,+want):\n%s", diff)
+func TestFilterInclude(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		f    filter
+		p    process
+		want bool
+	}{
+		{"running R", filter{running: true}, process{state: "R"}, true},
+		{"running S", filter{running: true}, process{state: "S"}, false},
+		{"min-fds over", filter{minFDs: 10}, process{nfds: 11}, true},
+		{"min-fds equal", filter{minFDs: 10}, process{nfds: 10}, false},
+		{"min-fds unknown", filter{minFDs: 10}, process{nfds: -1}, false},
+		{"min-threads over", filter{minThreads: 4}, process{nthreads: 5}, true},
+		{"min-threads equal", filter{minThreads: 4}, process{nthreads: 4}, false},
+		{"leaders session", filter{leaders: true}, process{sid: 1, pgid: 1}, true},
+		{"leaders group", filter{leaders: true}, process{sid: 3, pgid: 1}, true},
+		{"leaders neither", filter{leaders: true}, process{sid: 3, pgid: 3}, false},
+		{"pids match", filter{pids: map[int]bool{1: true, 5: true}}, process{}, true},
+		{"pids mismatch", filter{pids: map[int]bool{5: true}}, process{}, false},
+		{"pids empty", filter{pids: map[int]bool{}}, process{}, false},
+		{"base match", filter{base: regexp.MustCompile("^myscript")}, process{name: "python3", base: "myscript.py"}, true},
+		{"base mismatch", filter{base: regexp.MustCompile("^myscript")}, process{name: "myscript", base: "python3"}, false},
+		{"exe match", filter{exe: regexp.MustCompile("^/usr/bin/")}, process{exe: "/usr/bin/python3"}, true},
+		{"exe mismatch", filter{exe: regexp.MustCompile("^/usr/bin/")}, process{exe: "/opt/python3"}, false},
+		{"exe none", filter{exe: regexp.MustCompile("")}, process{exe: ""}, false},
+		{"exe unreadable", filter{exe: regexp.MustCompile("")}, process{exe: "?"}, false},
+		{"all both", filter{ppid: 7, running: true}, process{ppid: 7, state: "R"}, true},
+		{"all one", filter{ppid: 7, running: true}, process{ppid: 7, state: "S"}, false},
+		{"any one", filter{ppid: 7, running: true, any: true}, process{ppid: 7, state: "S"}, true},
+		{"any pid", filter{pids: map[int]bool{1: true}, ppid: 1, any: true}, process{ppid: 0}, true},
+		{"any neither", filter{ppid: 7, running: true, any: true}, process{ppid: 8, state: "S"}, false},
+		{"any no filters", filter{any: true}, process{}, true},
+		{"any user", filter{user: "alice", running: true, any: true}, process{user: "bob", state: "R"}, false},
+		{"users match", filter{users: map[string]bool{"alice": true, "bob": true}}, process{user: "bob"}, true},
+		{"users mismatch", filter{users: map[string]bool{"alice": true}}, process{user: "bob"}, false},
+		{"users any", filter{users: map[string]bool{"alice": true}, running: true, any: true}, process{user: "bob", state: "R"}, true},
+		{"users invert", filter{users: map[string]bool{"alice": true}, invert: true}, process{user: "bob"}, true},
+		{"since after", filter{since: time.Unix(1000, 0)}, process{start: time.Unix(1001, 0)}, true},
+		{"since before", filter{since: time.Unix(1000, 0)}, process{start: time.Unix(999, 0)}, false},
+		{"since unknown", filter{since: time.Unix(1000, 0)}, process{}, false},
+		{"invert match", filter{running: true, invert: true}, process{state: "R"}, false},
+		{"invert mismatch", filter{running: true, invert: true}, process{state: "S"}, true},
+		{"invert any", filter{ppid: 7, running: true, any: true, invert: true}, process{ppid: 8, state: "S"}, true},
+		{"invert user", filter{user: "alice", running: true, invert: true}, process{user: "bob", state: "S"}, false},
+		{"invert self", filter{thisPID: 1, running: true, invert: true}, process{state: "S"}, false},
+	} {
+		p := tt.p
+		p.pid, p.tgid = 1, 1
+		if got := tt.f.include(&p); got != tt.want {
+			t.Errorf("%s: got %t; want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestListerPCPU(t *testing.T) {
+	p := &process{utime: 3 * time.Second, stime: time.Second, uptime: 5 * time.Second}
+	l := &lister{}
+	if got, want := l.pcpu(p), percent(80); got != want {
+		t.Errorf("pcpu: got %s; want %s", got, want)
+	}
+	l.ncpu = 8
+	if got, want := l.pcpu(p), percent(10); got != want {
+		t.Errorf("pcpu with 8 CPUs: got %s; want %s", got, want)
+	}
+	if got := l.pcpu(&process{}); got != 0 {
+		t.Errorf("pcpu with zero uptime: got %s; want 0", got)
+	}
+}
+
+func TestFirstByStart(t *testing.T) {
+	base := time.Date(2021, 9, 14, 0, 0, 0, 0, time.UTC)
+	newPS := func() []*process {
+		return []*process{
+			{pid: 1, start: base},
+			{pid: 50, start: base.Add(3 * time.Hour)},
+			{pid: 20, start: base.Add(time.Hour)},
+			{pid: 30, start: base.Add(2 * time.Hour)},
+		}
+	}
+	pids := func(ps []*process) []int {
+		var pids []int
+		for _, p := range ps {
+			pids = append(pids, p.pid)
+		}
+		return pids
+	}
+	if got, want := pids(firstByStart(newPS(), 2, true)), []int{50, 30}; !cmp.Equal(got, want) {
+		t.Errorf("newest 2: got %v; want %v", got, want)
+	}
+	if got, want := pids(firstByStart(newPS(), 3, false)), []int{1, 20, 30}; !cmp.Equal(got, want) {
+		t.Errorf("oldest 3: got %v; want %v", got, want)
+	}
+	if got, want := pids(firstByStart(newPS(), 10, false)), []int{1, 20, 30, 50}; !cmp.Equal(got, want) {
+		t.Errorf("oldest 10: got %v; want %v", got, want)
 	}
 }
 
@@ -63,6 +207,9 @@ func TestFillChildDesc(t *testing.T) {
 		{pid: 20, ppid: 19},
 		{pid: 21, ppid: 19},
 	}
+	for _, p := range ps {
+		p.tgid = p.pid
+	}
 	fillChildDesc(ps)
 
 	want := []*process{
@@ -79,11 +226,102 @@ func TestFillChildDesc(t *testing.T) {
 		{pid: 20, ppid: 19, nchild: 0, ndesc: 0},
 		{pid: 21, ppid: 19, nchild: 0, ndesc: 0},
 	}
+	for _, p := range want {
+		p.tgid = p.pid
+	}
+	if diff := cmp.Diff(ps, want, cmp.AllowUnexported(process{})); diff != "" {
+		t.Errorf("fillChildDesc filled incorrectly (-got,+want):\n%s", diff)
+	}
+}
+
+func TestFillChildDescThreads(t *testing.T) {
+	// In -threads mode, the extra threads of a process are neither
+	// children of its parent nor parents themselves.
+	ps := []*process{
+		{pid: 1, tgid: 1, ppid: 0},
+		{pid: 5, tgid: 5, ppid: 1},
+		{pid: 6, tgid: 5, ppid: 1},
+		{pid: 7, tgid: 5, ppid: 1},
+		{pid: 10, tgid: 10, ppid: 5},
+		{pid: 11, tgid: 10, ppid: 5},
+	}
+	fillChildDesc(ps)
+
+	want := []*process{
+		{pid: 1, tgid: 1, ppid: 0, nchild: 1, ndesc: 2},
+		{pid: 5, tgid: 5, ppid: 1, nchild: 1, ndesc: 1},
+		{pid: 6, tgid: 5, ppid: 1, nchild: 1, ndesc: 1},
+		{pid: 7, tgid: 5, ppid: 1, nchild: 1, ndesc: 1},
+		{pid: 10, tgid: 10, ppid: 5, nchild: 0, ndesc: 0},
+		{pid: 11, tgid: 10, ppid: 5, nchild: 0, ndesc: 0},
+	}
 	if diff := cmp.Diff(ps, want, cmp.AllowUnexported(process{})); diff != "" {
 		t.Errorf("fillChildDesc filled incorrectly (-got,+want):\n%s", diff)
 	}
 }
 
+func TestFillDepth(t *testing.T) {
+	ps := []*process{
+		{pid: 1, ppid: 0},
+		{pid: 2, ppid: 1},
+		{pid: 3, ppid: 2},
+		{pid: 4, ppid: 3},
+		{pid: 5, ppid: 1},
+		{pid: 20, ppid: 19}, // parent exited
+		{pid: 21, ppid: 20},
+		// A cycle (due to pid reuse).
+		{pid: 30, ppid: 31},
+		{pid: 31, ppid: 30},
+	}
+	byPID := pidMap(ps)
+	for _, p := range ps {
+		p.parent = byPID[p.ppid]
+	}
+	// Start from the bottom of the tree to exercise the memoization.
+	for i, j := 0, len(ps)-1; i < j; i, j = i+1, j-1 {
+		ps[i], ps[j] = ps[j], ps[i]
+	}
+	fillDepth(ps)
+
+	got := make(map[int]int)
+	for _, p := range ps {
+		got[p.pid] = p.depth
+	}
+	want := map[int]int{1: 0, 2: 1, 3: 2, 4: 3, 5: 1, 20: 0, 21: 1, 30: 0, 31: 1}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("fillDepth (-got,+want):\n%s", diff)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	root := &process{pid: 1, name: "init"}
+	sh := &process{pid: 5, ppid: 1, name: "sh", parent: root}
+	ps := []*process{
+		sh,
+		{pid: 6, ppid: 5, name: `a"b`, parent: sh},
+		{pid: 7, ppid: 5, name: "c", parent: sh},
+		{pid: 8, ppid: 3, name: "orphan"},
+	}
+	var buf bytes.Buffer
+	if err := writeDOT(&buf, ps); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph processes {
+	5 [label="5 sh"];
+	6 [label="6 a\"b"];
+	7 [label="7 c"];
+	8 [label="8 orphan"];
+	1 [label="1 init", style=dashed];
+	1 -> 5;
+	5 -> 6;
+	5 -> 7;
+}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("writeDOT: got\n%s\nwant\n%s", got, want)
+	}
+}
+
 func TestTableWriter(t *testing.T) {
 	tw := newTableWriter(colPID|colName|colPPID, true)
 	tw.termWidth = 100
@@ -119,6 +357,21 @@ pid  ppid  name
 	}
 
 	buf.Reset()
+	tw.wide = true
+	tw.write(&buf)
+	want = `
+pid  ppid  name
+  3   123  abc
+ 10   123  d
+ 11     1  uvwxyz
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+
+	buf.Reset()
+	tw.wide = false
 	tw.termWidth = 10 // Too small for trimming.
 	tw.write(&buf)
 	want = `
@@ -133,6 +386,747 @@ pid  ppid  name
 	}
 }
 
+func TestTableWriterSep(t *testing.T) {
+	for _, tt := range []struct {
+		sep  string
+		want string
+	}{
+		{"|", "pid|ppid|name\n  3| 123|abc\n 10|   1|d\n"},
+		{"\t", "pid\tppid\tname\n3\t123\tabc\n10\t1\td\n"},
+	} {
+		tw := newTableWriter(colPID|colName|colPPID, true)
+		tw.sep = tt.sep
+		tw.append([]string{"3", "123", "abc"})
+		tw.append([]string{"10", "1", "d"})
+		var buf bytes.Buffer
+		tw.write(&buf)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("with sep %q: got %q; want %q", tt.sep, got, tt.want)
+		}
+	}
+}
+
+func TestTableWriterMaxColWidth(t *testing.T) {
+	tw := newTableWriter(colPID|colName|colCmdline, true)
+	tw.termWidth = 100
+	tw.maxColWidth = 8
+	tw.append([]string{"3", "abc", "/usr/bin/python3 -m http.server"})
+	tw.append([]string{"10", "abcdefghijkl", "sleep 1"})
+	var buf bytes.Buffer
+	tw.write(&buf)
+	want := `
+pid  name      cmdline
+  3  abc       /usr/...
+ 10  abcde...  sleep 1
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"sleep 1", 10, "sleep 1"},
+		{"abcdefghijkl", 8, "abcde..."},
+		{"abcdef", 2, "ab"},
+		{"naïve café", 10, "naïve café"},
+		{"naïve café", 6, "naï..."},
+		{"日本語のテキスト", 5, "日本..."},
+		{"日本語", 2, "日本"},
+	} {
+		got := truncate(tt.s, tt.n)
+		if got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q; want %q", tt.s, tt.n, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) gave invalid UTF-8", tt.s, tt.n)
+		}
+	}
+}
+
+func TestProcessWriteCmdWidth(t *testing.T) {
+	cols := colPID | colCmdline | colEnviron
+	tw := newTableWriter(cols, true)
+	tw.termWidth = 100
+	tw.cmdWidth = 10
+	p := &process{pid: 3, cmdline: "/usr/bin/python3 -m http.server", environ: []string{"A=1"}}
+	p.write(tw, cols)
+	var buf bytes.Buffer
+	tw.write(&buf)
+	want := `
+pid  cmdline     environ
+  3  /usr/bi...  A=1
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+}
+
+func TestTableWriterColor(t *testing.T) {
+	tw := newTableWriter(colPID|colName, true)
+	tw.termWidth = 12
+	tw.append([]string{"3", "abc"})
+	tw.setColor(ansiRed)
+	tw.append([]string{"10", "abcdefghijkl"})
+	tw.setColor(ansiYellow)
+	tw.append([]string{"11", "d"})
+
+	var buf bytes.Buffer
+	tw.write(&buf)
+	want := "pid  name\n" +
+		ansiRed + "  3  abc" + ansiReset + "\n" +
+		ansiYellow + " 10  abcd..." + ansiReset + "\n" +
+		" 11  d\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%q\nwant:\n\n%q\n", got, want)
+	}
+}
+
+func TestProcessColor(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		p    process
+		want string
+	}{
+		{"zombie", process{state: "Z", user: "alice"}, ansiRed},
+		{"hog", process{uptime: time.Minute, selfCPU: 40 * time.Second, cpuTime: 40 * time.Second}, ansiYellow},
+		// A shell whose children used a lot of CPU isn't a hog.
+		{"busy children", process{uptime: time.Minute, selfCPU: time.Second, cpuTime: 50 * time.Second, user: "alice"}, ansiCyan},
+		{"other user", process{uptime: time.Minute, user: "bob"}, ""},
+	} {
+		if got := tt.p.color("alice"); got != tt.want {
+			t.Errorf("%s: got color %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMaxRSS(t *testing.T) {
+	for _, tt := range []struct {
+		rss  []bytesize
+		want int
+	}{
+		{nil, -1},
+		{[]bytesize{0, 0}, -1},
+		{[]bytesize{10, 30, 20}, 1},
+		{[]bytesize{30, 10, 30}, 0},
+	} {
+		var ps []*process
+		for _, rss := range tt.rss {
+			ps = append(ps, &process{rss: rss})
+		}
+		if got := maxRSS(ps); got != tt.want {
+			t.Errorf("maxRSS(%v): got %d; want %d", tt.rss, got, tt.want)
+		}
+	}
+}
+
+func TestTableWriterTotal(t *testing.T) {
+	ps := []*process{
+		{pid: 3, name: "abc", nthreads: 2, nfds: 10},
+		{pid: 10, name: "d", nthreads: 1, nfds: -1},
+		{pid: 11, name: "uvwxyz", nthreads: 8, nfds: 5},
+	}
+	cols := colPID | colName | colNThreads | colNFDs
+	tw := newTableWriter(cols, true)
+	for _, p := range ps {
+		p.write(tw, cols)
+	}
+	tw.appendFooter(totalRows(ps, cols, 0)...)
+
+	var buf bytes.Buffer
+	tw.write(&buf)
+	want := `
+  pid  name    nthreads  nfds
+    3  abc            2    10
+   10  d              1     ?
+   11  uvwxyz         8     5
+-----  ------  --------  ----
+TOTAL                11    15
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+
+	// With only summable columns, the label goes on its own line.
+	cols = colNThreads | colNFDs
+	tw = newTableWriter(cols, true)
+	for _, p := range ps {
+		p.write(tw, cols)
+	}
+	tw.appendFooter(totalRows(ps, cols, 0)...)
+	buf.Reset()
+	tw.write(&buf)
+	want = `
+nthreads  nfds
+       2    10
+       1     ?
+       8     5
+--------  ----
+   TOTAL      
+      11    15
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+
+	// Unknown (-1) sizes don't count.
+	ps = []*process{
+		{pid: 3, rss: 3000},
+		{pid: 10, rss: -1},
+	}
+	cols = colPID | colRSS
+	tw = newTableWriter(cols, true)
+	for _, p := range ps {
+		p.write(tw, cols)
+	}
+	tw.appendFooter(totalRows(ps, cols, 0)...)
+	buf.Reset()
+	tw.write(&buf)
+	want = `
+  pid     rss
+    3  3.0 kB
+   10       ?
+-----  ------
+TOTAL  3.0 kB
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+}
+
+func TestUserSummary(t *testing.T) {
+	ps := []*process{
+		{user: "alice", rss: 1000, cpuTime: time.Second},
+		{user: "bob", rss: 5000, cpuTime: 3 * time.Second},
+		{user: "alice", rss: 2000, cpuTime: time.Minute},
+		{user: "carol", rss: 3000},
+		{user: "carol", rss: -1},
+	}
+	tw := userSummary(ps)
+	tw.termWidth = 0
+	var buf bytes.Buffer
+	tw.write(&buf)
+	want := `
+user   nproc     rss  cputime
+bob        1  5.0 kB       3s
+alice      2  3.0 kB     1m1s
+carol      2  3.0 kB       0s
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+}
+
+func TestStateSummary(t *testing.T) {
+	ps := []*process{
+		{state: "S"},
+		{state: "R"},
+		{state: "S"},
+		{state: "D"},
+		{state: "Z"},
+		{state: "S"},
+		{state: "D"},
+	}
+	tw := stateSummary(ps)
+	tw.termWidth = 0
+	var buf bytes.Buffer
+	tw.write(&buf)
+	want := `
+state  nproc  desc
+S          3  sleeping
+D          2  uninterruptible disk sleep
+R          1  running
+Z          1  zombie
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+}
+
+func TestBaseName(t *testing.T) {
+	for _, tt := range []struct {
+		args string
+		name string
+		want string
+	}{
+		{"/usr/bin/python3\x00-m\x00http.server\x00", "python3", "python3"},
+		{"/usr/bin/python3\x00myscript.py\x00", "python3", "python3"},
+		{"bash\x00", "bash", "bash"},
+		{"-bash\x00", "bash", "-bash"},
+		{"sshd: alice@pts/0", "sshd", "sshd:"},
+		{"postgres: checkpointer   \x00\x00\x00", "postgres", "postgres:"},
+		{"/opt/app/\x00", "app", "app"},
+		{"", "kthreadd", "[kthreadd]"},
+		// Paths with spaces.
+		{"/opt/My App/bin/x\x00--flag\x00", "x", "x"},
+		{"/opt/My App/bin/x\x00", "x", "x"},
+		{"/opt/My App/bin/some-long-program-name\x00", "some-long-progr", "some-long-program-name"},
+		{"/opt/My App\x00", "My App", "My App"},
+	} {
+		if got := baseName([]byte(tt.args), tt.name); got != tt.want {
+			t.Errorf("baseName(%q, %q): got %q; want %q", tt.args, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	for _, tt := range []struct {
+		glob  string
+		match []string
+		miss  []string
+	}{
+		{"*.py", []string{"a.py", ".py", "dir/x.py"}, []string{"a.pyc", "apy"}},
+		{"python?", []string{"python3"}, []string{"python", "python27"}},
+		{"[bc]ash", []string{"bash", "cash"}, []string{"dash"}},
+		{"[!bc]ash", []string{"dash"}, []string{"bash"}},
+		{"a+b(c)", []string{"a+b(c)"}, []string{"aab(c)", "a+bc"}},
+		{`\*x`, []string{"*x"}, []string{"ax"}},
+		{"[x", []string{"[x"}, []string{"x"}},
+	} {
+		re, err := compilePattern(tt.glob, true)
+		if err != nil {
+			t.Errorf("compilePattern(%q): %s", tt.glob, err)
+			continue
+		}
+		for _, s := range tt.match {
+			if !re.MatchString(s) {
+				t.Errorf("glob %q (regexp %s) doesn't match %q", tt.glob, re, s)
+			}
+		}
+		for _, s := range tt.miss {
+			if re.MatchString(s) {
+				t.Errorf("glob %q (regexp %s) matches %q", tt.glob, re, s)
+			}
+		}
+	}
+}
+
+func TestExceptCols(t *testing.T) {
+	got, err := exceptCols("cmdline, pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := supportedCols &^ (colCmdline | colPID); got != want {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	if _, err := exceptCols("pid,bogus"); err == nil {
+		t.Error("exceptCols with unknown column: got nil error")
+	}
+}
+
+func TestReadColsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range []struct {
+		contents string
+		want     column
+		ok       bool
+	}{
+		{"pid,user\n", colPID | colUser, true},
+		{"# profile\npid\n\n rss , cmdline\n", colPID | colRSS | colCmdline, true},
+		{"pid,,user", colPID | colUser, true},
+		{"pid\nbogus\n", 0, false},
+		{"# nothing\n\n", 0, false},
+	} {
+		name := filepath.Join(dir, "profile.cols")
+		if err := ioutil.WriteFile(name, []byte(tt.contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readColsFile(name)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("readColsFile(%q): got nil error", tt.contents)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readColsFile(%q): %s", tt.contents, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("readColsFile(%q): got %v; want %v", tt.contents, got, tt.want)
+		}
+	}
+	if _, err := readColsFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("readColsFile of missing file: got nil error")
+	}
+}
+
+func TestReadPIDs(t *testing.T) {
+	var pids map[int]bool
+	if err := (pidsFlag{&pids}).Set("10,20"); err != nil {
+		t.Fatal(err)
+	}
+	if err := readPIDs(strings.NewReader("30\n\n 40 \n10\n"), &pids); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]bool{10: true, 20: true, 30: true, 40: true}
+	if diff := cmp.Diff(pids, want); diff != "" {
+		t.Errorf("pids (-got,+want):\n%s", diff)
+	}
+	if got := (pidsFlag{&pids}).String(); got != "10,20,30,40" {
+		t.Errorf("pidsFlag.String: got %q", got)
+	}
+
+	pids = nil
+	if err := readPIDs(strings.NewReader(""), &pids); err != nil {
+		t.Fatal(err)
+	}
+	if pids == nil || len(pids) != 0 {
+		t.Errorf("readPIDs with empty input: got %v; want empty set", pids)
+	}
+	for _, s := range []string{"abc\n", "-1\n", "0\n"} {
+		if err := readPIDs(strings.NewReader(s), &pids); err == nil {
+			t.Errorf("readPIDs(%q): got nil error", s)
+		}
+	}
+}
+
+func TestSignalFlag(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want syscall.Signal
+	}{
+		{"TERM", syscall.SIGTERM},
+		{"term", syscall.SIGTERM},
+		{"SIGKILL", syscall.SIGKILL},
+		{"9", syscall.SIGKILL},
+		{"HUP", syscall.SIGHUP},
+	} {
+		var sig syscall.Signal
+		if err := (signalFlag{&sig}).Set(tt.in); err != nil {
+			t.Errorf("signalFlag.Set(%q): %s", tt.in, err)
+			continue
+		}
+		if sig != tt.want {
+			t.Errorf("signalFlag.Set(%q): got %s; want %s", tt.in, sig, tt.want)
+		}
+	}
+	for _, in := range []string{"", "BOGUS", "0", "-3"} {
+		var sig syscall.Signal
+		if err := (signalFlag{&sig}).Set(in); err == nil {
+			t.Errorf("signalFlag.Set(%q): got signal %d; want error", in, sig)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	const config = `
+# comment
+cols = pid,rss
+total
+width=100
+`
+	for _, tt := range []struct {
+		args []string
+		want map[string]string
+	}{
+		{
+			args: nil,
+			want: map[string]string{"cols": "pid,rss", "full": "false", "total": "true", "width": "100"},
+		},
+		{
+			args: []string{"-width", "80"},
+			want: map[string]string{"cols": "pid,rss", "full": "false", "total": "true", "width": "80"},
+		},
+		{
+			args: []string{"-full", "-total=false"},
+			want: map[string]string{"cols": "", "full": "true", "total": "false", "width": "100"},
+		},
+		{
+			// The config file's cols and total can't be used with
+			// -by-user, so they're ignored.
+			args: []string{"-by-user"},
+			want: map[string]string{"cols": "", "total": "false", "width": "100", "by-user": "true"},
+		},
+	} {
+		fs := flag.NewFlagSet("lp", flag.ContinueOnError)
+		fs.String("cols", "", "")
+		fs.Bool("full", false, "")
+		fs.Bool("total", false, "")
+		fs.Int("width", 0, "")
+		fs.Bool("by-user", false, "")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyConfig(fs, strings.NewReader(config), "config", false); err != nil {
+			t.Fatalf("applyConfig with args %q: %s", tt.args, err)
+		}
+		for name, want := range tt.want {
+			if got := fs.Lookup(name).Value.String(); got != want {
+				t.Errorf("with args %q: got -%s=%q; want %q", tt.args, name, got, want)
+			}
+		}
+	}
+
+	// When $LP_COLS chooses the columns, the config file's column
+	// selection (including -only, which would hide the header) is
+	// ignored.
+	fs := flag.NewFlagSet("lp", flag.ContinueOnError)
+	fs.String("only", "", "")
+	fs.Bool("total", false, "")
+	if err := applyConfig(fs, strings.NewReader("only=pid\ntotal\n"), "config", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("only").Value.String(); got != "" {
+		t.Errorf("with $LP_COLS: got -only=%q; want none", got)
+	}
+	if got := fs.Lookup("total").Value.String(); got != "true" {
+		t.Errorf("with $LP_COLS: got -total=%q; want true", got)
+	}
+
+	for _, config := range []string{
+		"bogus=1",
+		"cols",
+		"total=maybe",
+		"name=^sh$",
+		"kill=TERM",
+		"yes",
+	} {
+		fs := flag.NewFlagSet("lp", flag.ContinueOnError)
+		fs.String("cols", "", "")
+		fs.Bool("total", false, "")
+		fs.String("name", "", "")
+		fs.String("kill", "", "")
+		fs.Bool("yes", false, "")
+		if err := applyConfig(fs, strings.NewReader(config), "config", false); err == nil {
+			t.Errorf("applyConfig(%q): got nil error", config)
+		}
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want bool
+	}{
+		{"by-user", "total", true},
+		{"total", "by-user", true},
+		{"wide", "width", true},
+		{"format", "duration-unit", true},
+		{"threads", "total", true},
+		{"total", "width", false},
+		{"cols", "cols", false},
+	} {
+		if got := conflicts(tt.a, tt.b); got != tt.want {
+			t.Errorf("conflicts(%q, %q) = %t; want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMemSummary(t *testing.T) {
+	ps := []*process{
+		{rss: 10e6, pss: 4e6, uss: 1e6},
+		{rss: 10e6, pss: 4e6, uss: 1e6},
+		{rss: 5e6, pss: -1, uss: -1},
+		{rss: -1, pss: 0, uss: 0},
+	}
+	tw, unknown := memSummary(ps)
+	if unknown != 2 {
+		t.Errorf("got %d unknown; want 2", unknown)
+	}
+	tw.termWidth = 100
+	var buf bytes.Buffer
+	tw.write(&buf)
+	want := `
+nproc    rss     pss     uss
+    4  25 MB  8.0 MB  2.0 MB
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+}
+
+func TestUniqSummary(t *testing.T) {
+	ps := []*process{
+		{base: "worker"},
+		{base: "bash"},
+		{base: "worker"},
+		{base: "sshd"},
+		{base: "worker"},
+		{base: "bash"},
+	}
+	tw := uniqSummary(ps, colBase)
+	tw.termWidth = 100
+	var buf bytes.Buffer
+	tw.write(&buf)
+	want := `
+count  base
+    3  worker
+    2  bash
+    1  sshd
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+}
+
+func TestWriteFormatted(t *testing.T) {
+	tmpl, cols, err := parseFormat(`{{.PID}} {{.RSS}} {{bytes 2048}} {{duration .CPUTime}} {{.Cmdline}} {{join "," .Environ}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := colPID | colRSS | colCPUTime | colCmdline | colEnviron; cols != want {
+		t.Errorf("got cols %b; want %b", cols, want)
+	}
+	ps := []*process{
+		{pid: 10, rss: 3 << 20, cpuTime: 90 * time.Second, cmdline: "sleep 10", environ: []string{"A=1", "B=2"}},
+		{pid: 11, rss: 0, cpuTime: 0, cmdline: "top"},
+	}
+	var buf bytes.Buffer
+	if err := writeFormatted(&buf, tmpl, ps); err != nil {
+		t.Fatal(err)
+	}
+	want := `
+10 3.1 MB 2.0 kB 1m30s sleep 10 A=1,B=2
+11 0 B 2.0 kB 0s top 
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+
+	tmpl, _, err = parseFormat("{{.Bogus}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFormatted(&buf, tmpl, ps); err == nil {
+		t.Error("writeFormatted with an unknown field: got nil error")
+	}
+
+	// Fields print the same as the table's cells.
+	tmpl, _, err = parseFormat(`{{.Uptime}} {{.NFDs}} {{.Environ}} {{duration .Uptime}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps = []*process{{uptime: 339 * time.Hour, nfds: -1}}
+	buf.Reset()
+	if err := writeFormatted(&buf, tmpl, ps); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "14d3h ? ? 339h0m\n"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	// Numeric fields can still be compared.
+	tmpl, _, err = parseFormat(`{{if gt .NFDs 10}}many{{else if eq .NFDs -1}}unknown{{else}}few{{end}} {{if gt .RSS 1000000}}big{{else}}small{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps = []*process{{nfds: 20, rss: 3 << 20}, {nfds: -1, rss: 100}, {nfds: 3, rss: -1}}
+	buf.Reset()
+	if err := writeFormatted(&buf, tmpl, ps); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "many big\nunknown small\nfew small\n"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestWriteTSV(t *testing.T) {
+	start := time.Date(2021, 9, 14, 16, 30, 0, 0, time.UTC)
+	ps := []*process{
+		{pid: 10, rss: 3 << 20, cpuTime: 1500 * time.Millisecond, start: start, cmdline: "sh -c 'a\tb\nc'"},
+		{pid: 11, rss: 0, cpuTime: 0, cmdline: "top"},
+	}
+	cols := colPID | colRSS | colCPUTime | colStarted | colCmdline
+	var buf bytes.Buffer
+	if err := writeTSV(&buf, cols, ps, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	want := `
+pid	rss	cputime	started	cmdline
+10	3145728	1.5	2021-09-14T16:30:00Z	sh -c 'a b c'
+11	0	0	?	top
+`
+	want = want[1:]
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n\n%s\nwant:\n\n%s\n", got, want)
+	}
+
+	buf.Reset()
+	if err := writeTSV(&buf, colPID|colCPUTime, ps[:1], time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "pid\tcputime\n10\t1500\n"; got != want {
+		t.Errorf("with -duration-unit ms: got %q; want %q", got, want)
+	}
+
+	buf.Reset()
+	if err := writeTSV(&buf, colPID|colRSS|colCPUTime, nil, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "pid\trss(bytes)\tcputime(s)\n"; got != want {
+		t.Errorf("with -units: got %q; want %q", got, want)
+	}
+}
+
+func TestColConfHeader(t *testing.T) {
+	for _, tt := range []struct {
+		col          column
+		units, raw   bool
+		durationUnit time.Duration
+		want         string
+	}{
+		{colRSS, false, true, 0, "rss"},
+		{colRSS, true, false, 0, "rss"},
+		{colRSS, true, false, time.Millisecond, "rss"},
+		{colRSS, true, true, 0, "rss(bytes)"},
+		{colUptime, true, false, 0, "uptime"},
+		{colUptime, true, true, time.Second, "uptime(s)"},
+		{colUptime, true, false, time.Millisecond, "uptime(ms)"},
+		{colPID, true, true, time.Second, "pid"},
+	} {
+		got := colConfs[tt.col].header(tt.units, tt.raw, tt.durationUnit)
+		if got != tt.want {
+			t.Errorf("header(%t, %t, %s) of %s: got %q; want %q",
+				tt.units, tt.raw, tt.durationUnit, colConfs[tt.col].name, got, tt.want)
+		}
+	}
+	// Every size and duration column needs a unit.
+	for _, cv := range (&process{}).values() {
+		switch cv.v.(type) {
+		case bytesize, time.Duration:
+			if colConfs[cv.col].unit == "" {
+				t.Errorf("column %s has no unit", colConfs[cv.col].name)
+			}
+		}
+	}
+}
+
+func TestFormatStart(t *testing.T) {
+	now := time.Date(2021, 9, 14, 16, 30, 0, 0, time.Local)
+	for _, tt := range []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Time{}, "?"},
+		{time.Date(2021, 9, 14, 8, 5, 3, 0, time.Local), "08:05:03"},
+		{time.Date(2021, 9, 13, 23, 59, 0, 0, time.Local), "Sep 13 23:59"},
+		{time.Date(2020, 9, 14, 8, 5, 3, 0, time.Local), "Sep 14 08:05"},
+	} {
+		if got := formatStart(tt.t, now); got != tt.want {
+			t.Errorf("formatStart(%s): got %q; want %q", tt.t, got, tt.want)
+		}
+	}
+}
+
 func TestFormatDuration(t *testing.T) {
 	for _, tt := range []struct {
 		in   string
@@ -158,3 +1152,199 @@ func TestFormatDuration(t *testing.T) {
 		}
 	}
 }
+
+func TestFormatDurationUnit(t *testing.T) {
+	for _, tt := range []struct {
+		d    time.Duration
+		unit time.Duration
+		want string
+	}{
+		{0, time.Second, "0"},
+		{145 * time.Nanosecond, time.Second, "0.000000145"},
+		{15*time.Millisecond + 900*time.Microsecond, time.Millisecond, "15.9"},
+		{4233 * time.Second, time.Second, "4233"},
+		{time.Hour + 10*time.Second + 111*time.Millisecond, time.Second, "3610.111"},
+		{time.Second + 5, time.Nanosecond, "1000000005"},
+	} {
+		got := formatDurationUnit(tt.d, tt.unit)
+		if got != tt.want {
+			t.Errorf("formatDurationUnit(%s, %s): got %s; want %s", tt.d, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestTimings(t *testing.T) {
+	var nilTimings *timings
+	nilTimings.mark()
+	nilTimings.lap("x") // must not panic
+
+	tm := newTimings()
+	tm.lap("b")
+	tm.lap("a")
+	tm.lap("b")
+	var buf bytes.Buffer
+	tm.write(&buf)
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		names = append(names, strings.Fields(line)[0])
+	}
+	if diff := cmp.Diff(names, []string{"b", "a", "total"}); diff != "" {
+		t.Errorf("timings phases (-got, +want):\n%s", diff)
+	}
+}
+
+func TestRFC3339Time(t *testing.T) {
+	tm := time.Date(2021, 3, 4, 5, 6, 7, 8, time.FixedZone("X", -7*3600))
+	if got, want := rfc3339Time(tm).String(), "2021-03-04T05:06:07-07:00"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got, want := rfc3339Time(time.Time{}).String(), "?"; got != want {
+		t.Errorf("zero time: got %q; want %q", got, want)
+	}
+}
+
+func TestGetUserNumeric(t *testing.T) {
+	l := &lister{numericUID: true}
+	if got, want := l.getUser(1000), "1000"; got != want {
+		t.Errorf("getUser(1000): got %q; want %q", got, want)
+	}
+	if l.users != nil {
+		t.Error("getUser with numericUID loaded the user cache")
+	}
+}
+
+func TestFormatUptime(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{"58.1234001s", "58.1s"},
+		{"1h10m33.111s", "1h11m"},
+		{"47h59m", "47h59m"},
+		{"47h59m59s", "48h0m"},
+		{"48h", "2d"},
+		{"48h29m", "2d"},
+		{"48h30m", "2d1h"},
+		{"71h59m", "3d"},
+		{"339h", "14d3h"},
+		{"12345h", "514d9h"},
+	} {
+		d, err := time.ParseDuration(tt.in)
+		if err != nil {
+			t.Errorf("invalid input %q", tt.in)
+			continue
+		}
+		if got := formatUptime(d); got != tt.want {
+			t.Errorf("formatUptime(%s): got %s; want %s", d, got, tt.want)
+		}
+	}
+}
+
+func TestColConfFormat(t *testing.T) {
+	// Only strings, plain integers, and types made for a single column
+	// may rely on the default formatting.
+	p := &process{nfds: -1, environ: []string{"A=1"}}
+	for _, cv := range p.values() {
+		switch cv.v.(type) {
+		case string, int, int32, rfc3339Time:
+			continue
+		}
+		if colConfs[cv.col].format == nil {
+			t.Errorf("column %s (of type %T) has no format function", colConfs[cv.col].name, cv.v)
+		}
+	}
+	got := p.cells(colNFDs|colEnviron|colRSS, 0)
+	if diff := cmp.Diff(got, []string{"0 B", "?", "A=1"}); diff != "" {
+		t.Errorf("cells (-got, +want):\n%s", diff)
+	}
+	for _, tt := range []struct {
+		ppid int
+		want string
+	}{
+		{0, "no"},
+		{1, "yes"},
+		{1234, "no"},
+	} {
+		p := &process{ppid: tt.ppid}
+		if got := p.cells(colReparented, 0); got[0] != tt.want {
+			t.Errorf("reparented with ppid %d: got %q; want %q", tt.ppid, got[0], tt.want)
+		}
+	}
+}
+
+func TestBytesizeIEC(t *testing.T) {
+	b := bytesize(3 << 20)
+	if got, want := b.String(), "3.1 MB"; got != want {
+		t.Errorf("SI: got %q; want %q", got, want)
+	}
+	iecBytes = true
+	defer func() { iecBytes = false }()
+	if got, want := b.String(), "3.0 MiB"; got != want {
+		t.Errorf("IEC: got %q; want %q", got, want)
+	}
+	if got, want := bytesize(-1).String(), "?"; got != want {
+		t.Errorf("IEC unknown: got %q; want %q", got, want)
+	}
+}
+
+func TestAncestorRows(t *testing.T) {
+	init := &process{pid: 1, name: "init"}
+	sshd := &process{pid: 10, ppid: 1, name: "sshd", parent: init}
+	bash := &process{pid: 20, ppid: 10, name: "bash", parent: sshd}
+	orphan := &process{pid: 30, ppid: 25, name: "worker"} // parent exited
+	var got []string
+	for _, p := range ancestorRows([]*process{bash, orphan}, false) {
+		got = append(got, p.name)
+	}
+	want := []string{"init", "  sshd", "    bash", "worker"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ancestorRows (-got, +want):\n%s", diff)
+	}
+	if sshd.name != "sshd" {
+		t.Errorf("ancestorRows modified the original process (name %q)", sshd.name)
+	}
+}
+
+func TestSummaryLine(t *testing.T) {
+	ps := []*process{
+		{state: "R", rss: 3 << 20},
+		{state: "S", rss: 1 << 20},
+		{state: "Z", rss: 0},
+		{state: "R", rss: -1},
+	}
+	if got, want := summaryLine(ps), "4 processes, 2 running, 1 zombie, 4.2 MB rss"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got, want := summaryLine(ps[1:2]), "1 process, 0 running, 0 zombie, 1.0 MB rss"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	loc := time.FixedZone("X", 3600)
+	now := time.Date(2021, 3, 4, 15, 30, 0, 0, loc)
+	for _, tt := range []struct {
+		in   string
+		want time.Time
+	}{
+		{"2021-03-01T10:00:00Z", time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)},
+		{"14:03", time.Date(2021, 3, 4, 14, 3, 0, 0, loc)},
+		{"14:03:20", time.Date(2021, 3, 4, 14, 3, 20, 0, loc)},
+		{"1h", time.Date(2021, 3, 4, 14, 30, 0, 0, loc)},
+		{"-90m", time.Date(2021, 3, 4, 14, 0, 0, 0, loc)},
+	} {
+		got, err := parseSince(tt.in, now)
+		if err != nil {
+			t.Errorf("parseSince(%q): %s", tt.in, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseSince(%q): got %s; want %s", tt.in, got, tt.want)
+		}
+	}
+	for _, in := range []string{"", "yesterday", "25:00", "--1h"} {
+		if _, err := parseSince(in, now); err == nil {
+			t.Errorf("parseSince(%q): got nil error", in)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+#include <errno.h>
+#include <libproc.h>
+#include <mach/mach_time.h>
+#include <sys/proc.h>
+#include <sys/proc_info.h>
+
+static int pidinfo(int pid, int flavor, void *buf, int size) {
+	int n = proc_pidinfo(pid, flavor, 0, buf, size);
+	if (n <= 0) {
+		return -errno;
+	}
+	return n;
+}
+*/
+import "C"
+
+// supportedCols are the columns that can be displayed on this OS.
+const supportedCols = colPID | colTGID | colPPID | colUser | colName | colState |
+	colPGID | colRSS | colUptime | colUtime | colStime | colCPUTime | colSelfCPU |
+	colNThreads | colNChild | colNDesc | colPCPU | colStarted | colStartedISO | colPName |
+	colDepth | colReparented | colArg0 | colBase | colCmdline
+
+// timebase converts mach absolute time units (used for the task CPU
+// times) to nanoseconds.
+var timebase C.mach_timebase_info_data_t
+
+func newLister(f *filter, needCols column) *lister {
+	C.mach_timebase_info(&timebase)
+	return &lister{
+		procRoot: "/proc",
+		needCols: needCols,
+		filter:   f,
+	}
+}
+
+// loadAll reads all the processes using libproc.
+func (l *lister) loadAll(ctx context.Context) ([]*process, error) {
+	if l.threads {
+		return nil, errors.New("-threads is not supported on macOS")
+	}
+	if l.procRoot != "/proc" {
+		return nil, errors.New("-proc-root is not supported on macOS")
+	}
+	// The number of processes may grow between the calls, so leave some
+	// room to spare.
+	n := C.proc_listallpids(nil, 0)
+	if n <= 0 {
+		return nil, errors.New("proc_listallpids failed")
+	}
+	pids := make([]C.int, n+n/4+16)
+	n = C.proc_listallpids(unsafe.Pointer(&pids[0]), C.int(len(pids))*C.int(unsafe.Sizeof(pids[0])))
+	if n <= 0 {
+		return nil, errors.New("proc_listallpids failed")
+	}
+	pids = pids[:n]
+	l.timings.lap("listpids")
+
+	now := time.Now()
+	var ps []*process
+	for _, pid := range pids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		p, err := l.loadProcess(int(pid), now)
+		if err == errNotAProcess {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+var errNotAProcess = errors.New("process exited")
+
+// darwinStates maps the pbi_status values to the letters used by ps(1).
+var darwinStates = map[C.uint32_t]string{
+	C.SRUN:   "R",
+	C.SSLEEP: "S",
+	C.SSTOP:  "T",
+	C.SZOMB:  "Z",
+}
+
+func (l *lister) loadProcess(pid int, now time.Time) (*process, error) {
+	// PROC_PIDTASKALLINFO gives us everything, but only for processes we
+	// are allowed to inspect. For other processes, fall back to
+	// PROC_PIDTBSDINFO, which lacks the memory and CPU usage.
+	var info C.struct_proc_taskallinfo
+	bsd := &info.pbsd
+	errno := procPidinfo(pid, C.PROC_PIDTASKALLINFO, unsafe.Pointer(&info), C.int(C.sizeof_struct_proc_taskallinfo))
+	haveTask := errno == 0
+	if errno == syscall.EPERM {
+		errno = procPidinfo(pid, C.PROC_PIDTBSDINFO, unsafe.Pointer(bsd), C.int(C.sizeof_struct_proc_bsdinfo))
+	}
+	if errno == syscall.ESRCH {
+		return nil, errNotAProcess
+	}
+	if errno != 0 {
+		return nil, os.NewSyscallError("proc_pidinfo", errno)
+	}
+
+	p := &process{
+		pid:  int(bsd.pbi_pid),
+		ppid: int(bsd.pbi_ppid),
+		pgid: int(bsd.pbi_pgid),
+		name: C.GoString(&bsd.pbi_comm[0]),
+	}
+	p.tgid = p.pid
+	start := time.Unix(int64(bsd.pbi_start_tvsec), int64(bsd.pbi_start_tvusec)*1000)
+	p.start = start
+	p.uptime = now.Sub(start)
+	if state, ok := darwinStates[bsd.pbi_status]; ok {
+		p.state = state
+	} else {
+		p.state = "?"
+	}
+	if haveTask {
+		task := &info.ptinfo
+		p.rss = bytesize(task.pti_resident_size)
+		p.utime = machTime(task.pti_total_user)
+		p.stime = machTime(task.pti_total_system)
+		p.selfCPU = p.utime + p.stime
+		p.cpuTime = p.selfCPU
+		p.nthreads = int32(task.pti_threadnum)
+	} else {
+		p.rss = -1
+	}
+	if l.needCols.has(colUser) {
+		p.user = l.getUser(uint32(bsd.pbi_uid))
+	}
+	if l.needCols.has(cmdlineCols) {
+		l.timings.mark()
+		args, err := unix.SysctlRaw("kern.procargs2", pid)
+		l.timings.lap("args")
+		switch {
+		case err == nil:
+			l.setCmdline(p, parseProcArgs(args))
+		case errors.Is(err, unix.ESRCH):
+			return nil, errNotAProcess
+		case errors.Is(err, unix.EINVAL), errors.Is(err, unix.EPERM):
+			// We aren't allowed to see the arguments (for another
+			// user's process, EINVAL is returned); leave cmdline
+			// empty.
+		default:
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// selfRSS returns the resident set size of lp itself (for -debug).
+func (l *lister) selfRSS() (bytesize, error) {
+	var info C.struct_proc_taskinfo
+	errno := procPidinfo(os.Getpid(), C.PROC_PIDTASKINFO, unsafe.Pointer(&info), C.int(C.sizeof_struct_proc_taskinfo))
+	if errno != 0 {
+		return 0, os.NewSyscallError("proc_pidinfo", errno)
+	}
+	return bytesize(info.pti_resident_size), nil
+}
+
+// procPidinfo calls proc_pidinfo, returning the errno on failure (or 0).
+func procPidinfo(pid int, flavor C.int, buf unsafe.Pointer, size C.int) syscall.Errno {
+	n := C.pidinfo(C.int(pid), flavor, buf, size)
+	if n < 0 {
+		return syscall.Errno(-n)
+	}
+	if n < size {
+		return syscall.EINVAL
+	}
+	return 0
+}
+
+func machTime(t C.uint64_t) time.Duration {
+	return time.Duration(uint64(t) * uint64(timebase.numer) / uint64(timebase.denom))
+}
+
+// parseProcArgs extracts the NUL-separated arguments from the result of the
+// kern.procargs2 sysctl. The format is argc (a 32-bit integer) followed by
+// the executable path, some NUL padding, and then the NUL-terminated
+// arguments (and after that, the environment).
+func parseProcArgs(b []byte) []byte {
+	if len(b) < 4 {
+		return nil
+	}
+	argc := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	// Skip the executable path and padding.
+	for len(b) > 0 && b[0] != 0 {
+		b = b[1:]
+	}
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	end := 0
+	for i := 0; i < argc && end < len(b); i++ {
+		for end < len(b) && b[end] != 0 {
+			end++
+		}
+		end++
+	}
+	if end > len(b) {
+		end = len(b)
+	}
+	return b[:end]
+}
@@ -0,0 +1,145 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+#include <sys/param.h>
+#include <sys/sysctl.h>
+#include <sys/user.h>
+*/
+import "C"
+
+// supportedCols are the columns that can be displayed on this OS.
+const supportedCols = colPID | colTGID | colPPID | colUser | colName | colState |
+	colPGID | colRSS | colUptime | colUtime | colStime | colCutime | colCstime |
+	colCPUTime | colSelfCPU | colNThreads | colNChild | colNDesc | colPCPU | colStarted | colStartedISO | colPName |
+	colDepth | colReparented | colArg0 | colBase | colSID | colCmdline
+
+func newLister(f *filter, needCols column) *lister {
+	return &lister{
+		pageSize: bytesize(os.Getpagesize()),
+		procRoot: "/proc",
+		needCols: needCols,
+		filter:   f,
+	}
+}
+
+// loadAll reads all the processes using the kern.proc.proc sysctl.
+func (l *lister) loadAll(ctx context.Context) ([]*process, error) {
+	if l.threads {
+		return nil, errors.New("-threads is not supported on FreeBSD")
+	}
+	if l.procRoot != "/proc" {
+		return nil, errors.New("-proc-root is not supported on FreeBSD")
+	}
+	b, err := unix.SysctlRaw("kern.proc.proc")
+	if err != nil {
+		return nil, err
+	}
+	l.timings.lap("sysctl")
+	now := time.Now()
+	var ps []*process
+	for len(b) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		kp := (*C.struct_kinfo_proc)(unsafe.Pointer(&b[0]))
+		size := int(kp.ki_structsize)
+		if size <= 0 || size > len(b) {
+			return nil, errors.New("malformed kern.proc.proc result")
+		}
+		b = b[size:]
+		p, err := l.loadProcess(kp, now)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// selfRSS returns the resident set size of lp itself (for -debug).
+func (l *lister) selfRSS() (bytesize, error) {
+	b, err := unix.SysctlRaw("kern.proc.pid", os.Getpid())
+	if err != nil {
+		return 0, err
+	}
+	if len(b) < C.sizeof_struct_kinfo_proc {
+		return 0, errors.New("malformed kern.proc.pid result")
+	}
+	kp := (*C.struct_kinfo_proc)(unsafe.Pointer(&b[0]))
+	return bytesize(kp.ki_rssize) * l.pageSize, nil
+}
+
+// freebsdStates maps the ki_stat values to the letters used by ps(1).
+var freebsdStates = map[C.char]string{
+	C.SRUN:   "R",
+	C.SSLEEP: "S",
+	C.SSTOP:  "T",
+	C.SZOMB:  "Z",
+	C.SWAIT:  "W",
+	C.SLOCK:  "L",
+}
+
+func (l *lister) loadProcess(kp *C.struct_kinfo_proc, now time.Time) (*process, error) {
+	p := &process{
+		pid:      int(kp.ki_pid),
+		ppid:     int(kp.ki_ppid),
+		pgid:     int(kp.ki_pgid),
+		sid:      int(kp.ki_sid),
+		name:     C.GoString(&kp.ki_comm[0]),
+		rss:      bytesize(kp.ki_rssize) * l.pageSize,
+		start:    timevalTime(kp.ki_start),
+		uptime:   now.Sub(timevalTime(kp.ki_start)),
+		utime:    timevalDuration(kp.ki_rusage.ru_utime),
+		stime:    timevalDuration(kp.ki_rusage.ru_stime),
+		cutime:   timevalDuration(kp.ki_rusage_ch.ru_utime),
+		cstime:   timevalDuration(kp.ki_rusage_ch.ru_stime),
+		nthreads: int32(kp.ki_numthreads),
+	}
+	p.tgid = p.pid
+	p.selfCPU = p.utime + p.stime
+	p.cpuTime = p.selfCPU + p.cutime + p.cstime
+	if state, ok := freebsdStates[kp.ki_stat]; ok {
+		p.state = state
+	} else {
+		p.state = "?"
+	}
+	if l.needCols.has(colUser) {
+		p.user = l.getUser(uint32(kp.ki_uid))
+	}
+	if l.needCols.has(cmdlineCols) {
+		l.timings.mark()
+		args, err := unix.SysctlRaw("kern.proc.args", p.pid)
+		l.timings.lap("args")
+		switch {
+		case err == nil:
+			l.setCmdline(p, args)
+		case errors.Is(err, unix.ESRCH), errors.Is(err, unix.EPERM):
+			// The process exited, or we aren't allowed to see
+			// its arguments; leave cmdline empty.
+		default:
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func timevalTime(tv C.struct_timeval) time.Time {
+	return time.Unix(int64(tv.tv_sec), int64(tv.tv_usec)*1000)
+}
+
+func timevalDuration(tv C.struct_timeval) time.Duration {
+	return time.Duration(tv.tv_sec)*time.Second + time.Duration(tv.tv_usec)*time.Microsecond
+}
@@ -0,0 +1,1334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// #include <unistd.h>
+import "C"
+
+// supportedCols are the columns that can be displayed on this OS.
+const supportedCols = numCols - 1
+
+func newLister(f *filter, needCols column) *lister {
+	clockTicksPerSec := C.sysconf(C._SC_CLK_TCK)
+	return &lister{
+		clockTick:     time.Second / time.Duration(clockTicksPerSec),
+		pageSize:      bytesize(os.Getpagesize()),
+		procRoot:      "/proc",
+		needCols:      needCols,
+		lastStatField: lastStatField(needCols),
+		filter:        f,
+	}
+}
+
+// loadAll reads all the processes (or threads) in l.procRoot.
+func (l *lister) loadAll(ctx context.Context) ([]*process, error) {
+	bp := scratchPool.Get().(*[]byte)
+	l.buf = *bp
+	defer func() {
+		*bp = l.buf
+		l.buf = nil
+		scratchPool.Put(bp)
+	}()
+
+	var err error
+	l.uptime, err = l.getUptime()
+	if err != nil {
+		return nil, err
+	}
+	l.timings.lap("uptime")
+	l.bootTime = time.Now().Add(-l.uptime)
+	if l.needCols.has(colCaps) {
+		l.allCaps = l.getAllCaps()
+	}
+	if l.needCols.has(colPorts) {
+		l.listenPorts, err = l.getListenPorts()
+		if err != nil {
+			return nil, err
+		}
+		l.timings.lap("net")
+	}
+	f, err := os.Open(l.procRoot)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+	l.timings.lap("readdir")
+	var ps []*process
+	for _, fi := range fis {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if l.threads {
+			tps, err := l.loadThreads(fi)
+			if err == errNotAProcess {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			ps = append(ps, tps...)
+			continue
+		}
+		p, err := l.loadProcess(l.procRoot, fi)
+		if err == errNotAProcess {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// scratchPool holds scratch buffers (as *[]byte) for the readAll,
+// countLines, and direntCount calls made while loading processes. Each
+// loadAll takes one for its lister's buf and returns it, grown to fit the
+// largest file it read, so that later loads don't allocate their own.
+var scratchPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+func (l *lister) getUptime() (time.Duration, error) {
+	f, err := os.Open(filepath.Join(l.procRoot, "uptime"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	b, err := l.readAll(f)
+	if err != nil {
+		return 0, err
+	}
+	i := bytes.IndexByte(b, ' ')
+	if i < 0 {
+		return 0, errors.New("malformed /proc/uptime")
+	}
+	return time.ParseDuration(string(b[:i]) + "s")
+}
+
+// getAllCaps returns the mask of all capabilities supported by the kernel
+// according to /proc/sys/kernel/cap_last_cap, or else all the
+// capabilities in capNames.
+func (l *lister) getAllCaps() uint64 {
+	lastCap := len(capNames) - 1
+	b, err := ioutil.ReadFile(filepath.Join(l.procRoot, "sys/kernel/cap_last_cap"))
+	if err == nil {
+		if n, err := strconv.Atoi(string(bytes.TrimSpace(b))); err == nil && n >= 0 && n < 64 {
+			lastCap = n
+		}
+	}
+	return 1<<(lastCap+1) - 1
+}
+
+// selfRSS returns the resident set size of lp itself (for -debug).
+func (l *lister) selfRSS() (bytesize, error) {
+	// Not l.procRoot, which might not be our /proc.
+	var p process
+	if err := l.parseStat(&p, "/proc/self/stat"); err != nil {
+		return 0, err
+	}
+	return p.rss, nil
+}
+
+var errNotAProcess = errors.New("/proc dir is not a pid")
+
+// loadProcess loads the process (or thread) described by the entry fi in
+// dir, which is the /proc root or a /proc/[pid]/task directory.
+func (l *lister) loadProcess(dir string, fi os.FileInfo) (*process, error) {
+	var p process
+	var err error
+	p.pid, err = strconv.Atoi(fi.Name())
+	if err != nil {
+		return nil, errNotAProcess
+	}
+	p.tgid = p.pid
+
+	if l.needCols.has(colUser) {
+		uid := fi.Sys().(*syscall.Stat_t).Uid
+		p.user = l.getUser(uid)
+	}
+
+	basePath := filepath.Join(dir, fi.Name())
+	l.timings.mark()
+	if l.needCols.has(statCols) {
+		if err := l.parseStat(&p, basePath+"/stat"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("stat")
+	}
+	if l.needCols.has(cmdlineCols) {
+		if err := l.parseCmdline(&p, basePath+"/cmdline"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("cmdline")
+	}
+	if l.needCols.has(colExe) {
+		if err := l.readExe(&p, basePath+"/exe"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("exe")
+	}
+	if l.needCols.has(colNFDs) {
+		if err := l.parseFDs(&p, basePath+"/fd"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("fd")
+	}
+	if l.needCols.has(fdLinkCols) {
+		if err := l.parseFDLinks(&p, basePath+"/fd"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("fdlinks")
+	}
+	if l.needCols.has(colNTasks) {
+		if err := l.parseTasks(&p, basePath+"/task"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("task")
+	}
+	if l.needCols.has(colEnviron) {
+		if err := l.parseEnviron(&p, basePath+"/environ"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("environ")
+	}
+	if l.needCols.has(colNMaps) {
+		if err := l.parseMaps(&p, basePath+"/maps"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("maps")
+	}
+	if l.needCols.has(smapsCols) {
+		if err := l.parseSmapsRollup(&p, basePath+"/smaps_rollup"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("smaps")
+	}
+	if l.needCols.has(statmCols) {
+		if err := l.parseStatm(&p, basePath+"/statm"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("statm")
+	}
+	// The sched and affinity columns come from system calls on the pid,
+	// which would be asking about some other process (or none) if the
+	// pids are from another /proc, such as a container's.
+	if l.needCols.has(colSchedPolicy) {
+		if l.foreignPIDs() {
+			p.schedPolicy = "?"
+		} else if err := l.getSchedPolicy(&p); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("sched")
+	}
+	if l.needCols.has(colAffinity) {
+		var set unix.CPUSet
+		if l.foreignPIDs() {
+			p.affinity = "?"
+		} else if err := unix.SchedGetaffinity(p.pid, &set); err != nil {
+			return nil, skipIfExited(wrapSyscallError("sched_getaffinity", err))
+		} else {
+			p.affinity = formatCPUList(&set)
+		}
+		l.timings.lap("affinity")
+	}
+	if l.needCols.has(colLoginUID) {
+		if err := l.parseLoginUID(&p, basePath+"/loginuid"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("loginuid")
+	}
+	if l.needCols.has(statusCols) {
+		if err := l.parseStatus(&p, basePath+"/status"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("status")
+	}
+	if l.needCols.has(nsCols) {
+		if err := l.readNamespaces(&p, basePath+"/ns"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("ns")
+	}
+	if l.needCols.has(colContainer) {
+		if err := l.parseCgroup(&p, basePath+"/cgroup"); err != nil {
+			return nil, skipIfExited(err)
+		}
+		l.timings.lap("cgroup")
+	}
+
+	return &p, nil
+}
+
+// loadThreads loads all the threads of the process described by the /proc
+// entry fi.
+func (l *lister) loadThreads(fi os.FileInfo) ([]*process, error) {
+	tgid, err := strconv.Atoi(fi.Name())
+	if err != nil {
+		return nil, errNotAProcess
+	}
+	dir := filepath.Join(l.procRoot, fi.Name(), "task")
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, skipIfExited(err)
+	}
+	defer f.Close()
+	fis, err := f.Readdir(0)
+	if err != nil {
+		return nil, skipIfExited(err)
+	}
+	var ps []*process
+	for _, fi := range fis {
+		p, err := l.loadProcess(dir, fi)
+		if err == errNotAProcess {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.tgid = tgid
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// skipIfExited converts errors that indicate that the process exited while
+// we were reading it into errNotAProcess. The pseudo-files could disappear
+// (or become unreadable) as we're trying to read them if the process exits.
+func skipIfExited(err error) error {
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ESRCH) {
+		return errNotAProcess
+	}
+	return err
+}
+
+func (l *lister) parseStat(p *process, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := l.readAll(f)
+	if err != nil {
+		return err
+	}
+
+	for col := 1; ; col++ {
+		for len(stat) > 0 && stat[0] == ' ' {
+			stat = stat[1:]
+		}
+		if len(stat) == 0 || stat[0] == '\n' {
+			// Older kernels don't report all the fields.
+			return nil
+		}
+		if col == 2 { // comm
+			if stat[0] != '(' {
+				return errors.New("malformed /stat")
+			}
+			i := bytes.LastIndexByte(stat, ')')
+			p.name = string(stat[1:i])
+			stat = stat[i+1:]
+			continue
+		}
+
+		i := bytes.IndexAny(stat, " \n")
+		if i < 0 {
+			i = len(stat)
+		}
+		b := stat[:i]
+		var err error
+		stat = stat[i:]
+		switch col {
+		case 3: // state
+			p.state = string(b)
+		case 4: // ppid
+			p.ppid, err = parseIntb(b)
+			if err != nil {
+				return err
+			}
+		case 5: // pgrp
+			p.pgid, err = parseIntb(b)
+			if err != nil {
+				return err
+			}
+		case 6: // session
+			p.sid, err = parseIntb(b)
+			if err != nil {
+				return err
+			}
+		case 14: // utime
+			utime, err := parseUint64b(b)
+			if err != nil {
+				return err
+			}
+			p.utime = time.Duration(utime) * l.clockTick
+		case 15: // stime
+			stime, err := parseUint64b(b)
+			if err != nil {
+				return err
+			}
+			p.stime = time.Duration(stime) * l.clockTick
+		case 16: // cutime
+			cutime, err := parseUint64b(b)
+			if err != nil {
+				return err
+			}
+			p.cutime = time.Duration(cutime) * l.clockTick
+		case 17: // cstime
+			cstime, err := parseUint64b(b)
+			if err != nil {
+				return err
+			}
+			p.cstime = time.Duration(cstime) * l.clockTick
+			p.selfCPU = p.utime + p.stime
+			p.cpuTime = p.selfCPU + p.cutime + p.cstime
+		case 20: // num_threads
+			p.nthreads, err = parseInt32b(b)
+			if err != nil {
+				return err
+			}
+		case 22: // starttime
+			startTime, err := parseUint64b(b)
+			if err != nil {
+				return err
+			}
+			sinceBoot := time.Duration(startTime) * l.clockTick
+			uptime := l.uptime - sinceBoot
+			if uptime < 0 {
+				uptime = 0
+			}
+			p.uptime = uptime
+			if l.needCols.has(colStarted) {
+				p.start = l.bootTime.Add(sinceBoot)
+			}
+		case 24: // rss
+			pages, err := parseInt64b(b)
+			if err != nil {
+				return err
+			}
+			p.rss = bytesize(pages) * l.pageSize
+		case 39: // processor
+			p.lastCPU, err = parseIntb(b)
+			if err != nil {
+				return err
+			}
+		case 40: // rt_priority
+			p.rtPrio, err = parseIntb(b)
+			if err != nil {
+				return err
+			}
+		case 42: // delayacct_blkio_ticks
+			blkioDelay, err := parseUint64b(b)
+			if err != nil {
+				return err
+			}
+			p.blkioDelay = time.Duration(blkioDelay) * l.clockTick
+		case 43: // guest_time
+			guestTime, err := parseUint64b(b)
+			if err != nil {
+				return err
+			}
+			p.guestTime = time.Duration(guestTime) * l.clockTick
+		}
+		if col == l.lastStatField {
+			// Done
+			return nil
+		}
+	}
+}
+
+// statCols are the columns derived from /proc/[pid]/stat (including nchild
+// and ndesc, which are computed from ppid).
+const statCols = colName | colState | colPPID | colPGID | colRSS | colUptime |
+	colUtime | colStime | colCutime | colCstime | colCPUTime | colSelfCPU | colNThreads |
+	colNChild | colNDesc | colLastCPU | colGuestTime | colBlkioDelay |
+	colRTPrio | colPCPU | colStarted | colStartedISO | colSID
+
+// lateStatFields gives the /proc/[pid]/stat field number of each column
+// that lives beyond rss (field 24). Normally parseStat stops after rss; it
+// only reads further when one of these columns is needed.
+var lateStatFields = map[column]int{
+	colLastCPU:    39,
+	colRTPrio:     40,
+	colBlkioDelay: 42,
+	colGuestTime:  43,
+}
+
+// lastStatField returns the last field of /proc/[pid]/stat that must be
+// read to fill in needCols.
+func lastStatField(needCols column) int {
+	last := 24
+	for col, field := range lateStatFields {
+		if needCols.has(col) && field > last {
+			last = field
+		}
+	}
+	return last
+}
+
+var schedPolicies = map[uintptr]string{
+	0: "OTHER",
+	1: "FIFO",
+	2: "RR",
+	3: "BATCH",
+	5: "IDLE",
+	6: "DEADLINE",
+}
+
+// schedResetOnFork is SCHED_RESET_ON_FORK, which may be ORed into the result
+// of sched_getscheduler.
+const schedResetOnFork = 0x40000000
+
+func (l *lister) getSchedPolicy(p *process) error {
+	policy, _, errno := unix.Syscall(unix.SYS_SCHED_GETSCHEDULER, uintptr(p.pid), 0, 0)
+	if errno != 0 {
+		return wrapSyscallError("sched_getscheduler", errno)
+	}
+	policy &^= schedResetOnFork
+	name, ok := schedPolicies[policy]
+	if !ok {
+		name = strconv.FormatUint(uint64(policy), 10)
+	}
+	p.schedPolicy = name
+	return nil
+}
+
+// formatCPUList formats the CPUs in set as a compact list of ranges
+// such as "0-3,8".
+func formatCPUList(set *unix.CPUSet) string {
+	var b []byte
+	n := len(*set) * 64
+	for cpu := 0; cpu < n; cpu++ {
+		if !set.IsSet(cpu) {
+			continue
+		}
+		start := cpu
+		for cpu+1 < n && set.IsSet(cpu+1) {
+			cpu++
+		}
+		if len(b) > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendInt(b, int64(start), 10)
+		if cpu > start {
+			b = append(b, '-')
+			b = strconv.AppendInt(b, int64(cpu), 10)
+		}
+	}
+	return string(b)
+}
+
+// statusCols are the columns derived from /proc/[pid]/status.
+const statusCols = colTGID | colGroups | colRUID | colEUID | colSeccomp |
+	colCaps | colUmask | sigCols | colNSPID
+
+// sigCols are the signal mask columns.
+const sigCols = colSigPnd | colSigBlk | colSigIgn | colSigCgt
+
+// seccompModes maps the Seccomp values in /proc/[pid]/status to names.
+var seccompModes = map[string]string{
+	"0": "none",
+	"1": "strict",
+	"2": "filter",
+}
+
+func (l *lister) parseStatus(p *process, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	status, err := l.readAll(f)
+	if err != nil {
+		return err
+	}
+
+	// Older kernels don't report these.
+	p.seccomp = "?"
+	p.umask = "?"
+	p.nsPID = -1
+	var pending uint64
+	err = forEachField(status, func(key string, v []byte) error {
+		var err error
+		switch key {
+		case "Tgid":
+			p.tgid, err = parseIntb(v)
+		case "Groups":
+			p.groups = strings.Join(strings.Fields(string(v)), ",")
+		case "Uid":
+			// Real, effective, saved set, and filesystem UIDs.
+			uids := bytes.Fields(v)
+			if len(uids) < 2 {
+				return errors.New("malformed Uid line")
+			}
+			var ruid, euid uint64
+			if ruid, err = parseUint64b(uids[0]); err != nil {
+				return err
+			}
+			if euid, err = parseUint64b(uids[1]); err != nil {
+				return err
+			}
+			p.ruid = l.getUser(uint32(ruid))
+			p.euid = l.getUser(uint32(euid))
+		case "Umask":
+			p.umask = string(v)
+		case "NSpid":
+			// The PID in each namespace from the outermost one
+			// (ours, usually) to the process's own.
+			pids := bytes.Fields(v)
+			if len(pids) == 0 {
+				return errors.New("malformed NSpid line")
+			}
+			p.nsPID, err = parseInt64b(pids[len(pids)-1])
+		case "SigPnd", "ShdPnd":
+			// Combine the signals pending for the thread and for the
+			// whole process.
+			var mask uint64
+			mask, err = strconv.ParseUint(unsafeString(v), 16, 64)
+			pending |= mask
+		case "SigBlk":
+			p.sigBlk, err = parseSigMask(v)
+		case "SigIgn":
+			p.sigIgn, err = parseSigMask(v)
+		case "SigCgt":
+			p.sigCgt, err = parseSigMask(v)
+		case "CapEff":
+			var caps uint64
+			caps, err = strconv.ParseUint(unsafeString(v), 16, 64)
+			p.caps = formatCaps(caps, l.allCaps)
+		case "Seccomp":
+			if mode, ok := seccompModes[string(v)]; ok {
+				p.seccomp = mode
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	p.sigPnd = formatSigMask(pending)
+	return nil
+}
+
+// parseSigMask parses a hex signal mask from /proc/[pid]/status and formats
+// it using formatSigMask.
+func parseSigMask(b []byte) (string, error) {
+	mask, err := strconv.ParseUint(unsafeString(b), 16, 64)
+	if err != nil {
+		return "", err
+	}
+	return formatSigMask(mask), nil
+}
+
+// formatSigMask formats a signal mask (where bit n-1 is set for signal n) as
+// a comma-separated list of signal names without the SIG prefix, such as
+// "INT,TERM". Signals without names (the real-time signals) are shown as
+// numbers.
+func formatSigMask(mask uint64) string {
+	var names []string
+	for i := uint(0); i < 64; i++ {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		sig := syscall.Signal(i + 1)
+		name := strings.TrimPrefix(unix.SignalName(sig), "SIG")
+		if name == "" {
+			name = strconv.Itoa(int(sig))
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+// capNames are the capability names from linux/capability.h, indexed by
+// capability number.
+var capNames = map[uint]string{
+	0:  "cap_chown",
+	1:  "cap_dac_override",
+	2:  "cap_dac_read_search",
+	3:  "cap_fowner",
+	4:  "cap_fsetid",
+	5:  "cap_kill",
+	6:  "cap_setgid",
+	7:  "cap_setuid",
+	8:  "cap_setpcap",
+	9:  "cap_linux_immutable",
+	10: "cap_net_bind_service",
+	11: "cap_net_broadcast",
+	12: "cap_net_admin",
+	13: "cap_net_raw",
+	14: "cap_ipc_lock",
+	15: "cap_ipc_owner",
+	16: "cap_sys_module",
+	17: "cap_sys_rawio",
+	18: "cap_sys_chroot",
+	19: "cap_sys_ptrace",
+	20: "cap_sys_pacct",
+	21: "cap_sys_admin",
+	22: "cap_sys_boot",
+	23: "cap_sys_nice",
+	24: "cap_sys_resource",
+	25: "cap_sys_time",
+	26: "cap_sys_tty_config",
+	27: "cap_mknod",
+	28: "cap_lease",
+	29: "cap_audit_write",
+	30: "cap_audit_control",
+	31: "cap_setfcap",
+	32: "cap_mac_override",
+	33: "cap_mac_admin",
+	34: "cap_syslog",
+	35: "cap_wake_alarm",
+	36: "cap_block_suspend",
+	37: "cap_audit_read",
+	38: "cap_perfmon",
+	39: "cap_bpf",
+	40: "cap_checkpoint_restore",
+}
+
+// formatCaps formats a capability mask as a comma-separated list of names
+// (or "none" or "all", if caps includes every capability in allCaps).
+func formatCaps(caps, allCaps uint64) string {
+	switch {
+	case caps == 0:
+		return "none"
+	case allCaps != 0 && caps&allCaps == allCaps:
+		return "all"
+	}
+	var names []string
+	for i := uint(0); i < 64; i++ {
+		if caps&(1<<i) == 0 {
+			continue
+		}
+		name, ok := capNames[i]
+		if !ok {
+			name = "cap_" + strconv.Itoa(int(i))
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+// forEachField calls fn for each "key: value" line of b (in the format of
+// /proc/[pid]/status and similar files), stopping at the first error. The
+// value passed to fn has surrounding whitespace trimmed and is only valid
+// for the duration of the call.
+func forEachField(b []byte, fn func(key string, v []byte) error) error {
+	for len(b) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i], b[i+1:]
+		} else {
+			line, b = b, nil
+		}
+		i := bytes.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		if err := fn(unsafeString(line[:i]), bytes.TrimSpace(line[i+1:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// smapsCols are the columns derived from /proc/[pid]/smaps_rollup.
+const smapsCols = colPSS | colUSS | colSwap
+
+// parseSmapsRollup fills in all the smapsCols fields from
+// /proc/[pid]/smaps_rollup in one pass.
+func (l *lister) parseSmapsRollup(p *process, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrPermission) {
+		p.pss, p.uss, p.swap = -1, -1, -1
+		return nil
+	}
+	if errors.Is(err, syscall.ESRCH) {
+		return nil // kernel threads have no memory
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		// Kernels before 4.14 don't have smaps_rollup. If the
+		// process directory is still there, the process didn't
+		// exit; we just can't tell its pss, uss, or swap.
+		if _, err := os.Stat(filepath.Dir(path)); err == nil {
+			p.pss, p.uss, p.swap = -1, -1, -1
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	smaps, err := l.readAll(f)
+	if errors.Is(err, os.ErrPermission) {
+		p.pss, p.uss, p.swap = -1, -1, -1
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return forEachField(smaps, func(key string, v []byte) error {
+		var n bytesize
+		var err error
+		switch key {
+		case "Pss":
+			p.pss, err = parseKB(v)
+		case "Private_Clean", "Private_Dirty":
+			n, err = parseKB(v)
+			p.uss += n
+		case "Swap":
+			p.swap, err = parseKB(v)
+		}
+		return err
+	})
+}
+
+// statmCols are the columns derived from /proc/[pid]/statm.
+const statmCols = colText | colData
+
+// parseStatm reads the memory sizes in /proc/[pid]/statm, which are all
+// given in pages: size, resident, shared, text, lib, data, and dt.
+func (l *lister) parseStatm(p *process, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := l.readAll(f)
+	if err != nil {
+		return err
+	}
+	fields := bytes.Fields(b)
+	if len(fields) < 6 {
+		return errors.New("malformed statm")
+	}
+	text, err := parseInt64b(fields[3])
+	if err != nil {
+		return err
+	}
+	data, err := parseInt64b(fields[5])
+	if err != nil {
+		return err
+	}
+	p.text = bytesize(text) * l.pageSize
+	p.data = bytesize(data) * l.pageSize
+	return nil
+}
+
+// parseKB parses a size such as "1306 kB" as found in /proc/[pid]/status
+// and smaps_rollup.
+func parseKB(b []byte) (bytesize, error) {
+	n, err := parseInt64b(bytes.TrimSuffix(b, []byte(" kB")))
+	if err != nil {
+		return 0, err
+	}
+	return bytesize(n) * 1024, nil
+}
+
+func (l *lister) parseCmdline(p *process, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmdline, err := l.readAll(f)
+	if err != nil {
+		return err
+	}
+	l.setCmdline(p, cmdline)
+	return nil
+}
+
+// unsetLoginUID is the loginuid of processes not started from a login
+// session (such as daemons started at boot).
+const unsetLoginUID = 1<<32 - 1
+
+func (l *lister) parseLoginUID(p *process, path string) error {
+	p.loginUID = "?"
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // kernel built without audit support
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := l.readAll(f)
+	if err != nil {
+		return err
+	}
+	uid, err := parseUint64b(bytes.TrimSpace(b))
+	if err != nil {
+		return err
+	}
+	if uid != unsetLoginUID {
+		p.loginUID = l.getUser(uint32(uid))
+	}
+	return nil
+}
+
+// containerIDRE matches the last element of a cgroup path that names a
+// container. The runtimes use various forms, such as
+//
+//	/docker/<id>                          (Docker, cgroup v1)
+//	/system.slice/docker-<id>.scope       (Docker with systemd)
+//	/kubepods/burstable/pod<uid>/<id>     (Kubernetes)
+//	.../cri-containerd-<id>.scope         (containerd with systemd)
+//	.../crio-<id>.scope                   (CRI-O)
+//	.../libpod-<id>.scope                 (Podman)
+var containerIDRE = regexp.MustCompile(`[/-]([0-9a-f]{64})(\.scope)?$`)
+
+// parseCgroup sets p.container to the short ID of the container that p
+// belongs to (if any), found in one of its cgroup paths.
+//
+// TODO: Resolving the ID to a container name would require asking the
+// container runtime (through its socket); for now, the ID can be passed to
+// docker ps and friends.
+func (l *lister) parseCgroup(p *process, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := l.readAll(f)
+	if err != nil {
+		return err
+	}
+	for len(b) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i], b[i+1:]
+		} else {
+			line, b = b, nil
+		}
+		// Each line is hierarchy-ID:controllers:path.
+		if m := containerIDRE.FindSubmatch(line); m != nil {
+			p.container = string(m[1][:12])
+			return nil
+		}
+	}
+	return nil
+}
+
+// nsCols are the columns derived from the /proc/[pid]/ns links.
+const nsCols = colPIDNS | colNetNS | colMntNS
+
+// readNamespaces fills in the nsCols fields from the links in the ns
+// directory dir, each of which looks like net:[4026531993].
+func (l *lister) readNamespaces(p *process, dir string) error {
+	for _, ns := range []struct {
+		col  column
+		name string
+		v    *string
+	}{
+		{colPIDNS, "pid", &p.pidNS},
+		{colNetNS, "net", &p.netNS},
+		{colMntNS, "mnt", &p.mntNS},
+	} {
+		if !l.needCols.has(ns.col) {
+			continue
+		}
+		link, err := os.Readlink(filepath.Join(dir, ns.name))
+		if errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+			// Zombies have no namespaces to link to. (If the
+			// process exited, we'll find out when reading its
+			// other files.)
+			*ns.v = "?"
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		inode := strings.TrimPrefix(link, ns.name+":[")
+		if len(inode) == len(link) || !strings.HasSuffix(inode, "]") {
+			return errors.New("malformed namespace link")
+		}
+		*ns.v = strings.TrimSuffix(inode, "]")
+	}
+	return nil
+}
+
+func (l *lister) readExe(p *process, path string) error {
+	exe, err := os.Readlink(path)
+	switch {
+	case err == nil:
+		p.exe = exe
+	case errors.Is(err, os.ErrPermission):
+		p.exe = "?"
+	case errors.Is(err, os.ErrNotExist):
+		// Kernel threads have no executable. (If the process
+		// exited, we'll find out when reading its other files.)
+	default:
+		return err
+	}
+	return nil
+}
+
+func (l *lister) parseEnviron(p *process, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrPermission) {
+		return nil // leave p.environ nil
+	}
+	if errors.Is(err, syscall.ESRCH) {
+		p.environ = []string{} // kernel threads have no environment
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	environ, err := l.readAll(f)
+	if errors.Is(err, os.ErrPermission) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p.environ = make([]string, 0, bytes.Count(environ, []byte{0}))
+	for len(environ) > 0 {
+		i := bytes.IndexByte(environ, 0)
+		if i < 0 {
+			i = len(environ)
+		}
+		p.environ = append(p.environ, string(environ[:i]))
+		environ = environ[i:]
+		if len(environ) > 0 {
+			environ = environ[1:]
+		}
+	}
+	return nil
+}
+
+func (l *lister) parseFDs(p *process, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrPermission) {
+		p.nfds = -1
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p.nfds, l.buf, err = direntCount(f, l.buf)
+	return err
+}
+
+// fdLinkCols are the columns derived from the links in /proc/[pid]/fd.
+const fdLinkCols = colNSockets | colNFiles | colPorts
+
+// parseFDLinks fills in the fdLinkCols fields by reading the link of each fd
+// in the fd directory dir. A socket's link looks like socket:[12345]; a
+// file's is its path.
+func (l *lister) parseFDLinks(p *process, dir string) error {
+	f, err := os.Open(dir)
+	if errors.Is(err, os.ErrPermission) {
+		p.nsockets, p.nfiles, p.ports = -1, -1, "?"
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	const socketPrefix = "socket:["
+	// Readlinkat truncates the link to fit the buffer, which is all we
+	// need to check the prefix and read a socket's inode.
+	var buf [32]byte
+	p.nsockets, p.nfiles = 0, 0
+	var ports []string
+	for _, name := range names {
+		n, err := unix.Readlinkat(int(f.Fd()), name, buf[:])
+		if err == unix.ENOENT {
+			continue // closed since we read the directory
+		}
+		if err == unix.EACCES {
+			p.nsockets, p.nfiles, p.ports = -1, -1, "?"
+			return nil
+		}
+		if err != nil {
+			return wrapSyscallError("readlinkat", err)
+		}
+		link := buf[:n]
+		switch {
+		case bytes.HasPrefix(link, []byte(socketPrefix)):
+			p.nsockets++
+			if l.listenPorts == nil {
+				continue
+			}
+			inode, err := parseUint64b(bytes.TrimSuffix(link[len(socketPrefix):], []byte("]")))
+			if err != nil {
+				return errors.New("malformed socket link")
+			}
+			if port, ok := l.listenPorts[inode]; ok {
+				ports = append(ports, port)
+			}
+		case len(link) > 0 && link[0] == '/':
+			p.nfiles++
+		}
+	}
+	p.ports = formatPorts(ports)
+	return nil
+}
+
+// formatPorts sorts ports (such as 22/tcp) by number, removes duplicates
+// (such as from listening on both IPv4 and IPv6), and joins them with
+// commas.
+func formatPorts(ports []string) string {
+	portNum := func(port string) int {
+		n, _ := strconv.Atoi(port[:strings.IndexByte(port, '/')])
+		return n
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		ni, nj := portNum(ports[i]), portNum(ports[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return ports[i] < ports[j]
+	})
+	var uniq []string
+	for i, port := range ports {
+		if i == 0 || port != ports[i-1] {
+			uniq = append(uniq, port)
+		}
+	}
+	return strings.Join(uniq, ",")
+}
+
+// netTables are the /proc/net files listing sockets, with the state that
+// means a socket of that kind is listening: TCP_LISTEN for TCP and
+// TCP_CLOSE (the state of a bound UDP socket that isn't connected) for UDP.
+var netTables = []struct {
+	name   string
+	proto  string
+	listen string
+}{
+	{"tcp", "tcp", "0A"},
+	{"tcp6", "tcp", "0A"},
+	{"udp", "udp", "07"},
+	{"udp6", "udp", "07"},
+}
+
+// getListenPorts reads the /proc/net socket tables and returns a map from
+// the inode of each listening socket to its port.
+func (l *lister) getListenPorts() (map[uint64]string, error) {
+	ports := make(map[uint64]string)
+	for _, t := range netTables {
+		f, err := os.Open(filepath.Join(l.procRoot, "net", t.name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue // no IPv6, for instance
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := l.readAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := parseNetTable(b, t.proto, t.listen, ports); err != nil {
+			return nil, fmt.Errorf("reading /proc/net/%s: %s", t.name, err)
+		}
+	}
+	return ports, nil
+}
+
+// parseNetTable parses the contents of a /proc/net socket table such as
+// /proc/net/tcp, adding the sockets in state listen to ports.
+//
+// UDP has no listening state, so for UDP we use 07 (TCP_CLOSE), the state of
+// every socket that hasn't called connect. That includes unconnected client
+// sockets that have sent a datagram (and so were given an ephemeral port),
+// which the kernel doesn't distinguish from servers; their ports show up in
+// the ports column too. (Connected UDP sockets are in state 01 and are left
+// out.)
+func parseNetTable(b []byte, proto, listen string, ports map[uint64]string) error {
+	// Skip the header line.
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		b = b[i+1:]
+	} else {
+		b = nil
+	}
+	for len(b) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i], b[i+1:]
+		} else {
+			line, b = b, nil
+		}
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ...
+		fields := bytes.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		if string(fields[3]) != listen {
+			continue
+		}
+		local := fields[1]
+		i := bytes.LastIndexByte(local, ':')
+		if i < 0 {
+			return errors.New("malformed local address")
+		}
+		port, err := strconv.ParseUint(unsafeString(local[i+1:]), 16, 16)
+		if err != nil {
+			return err
+		}
+		inode, err := parseUint64b(fields[9])
+		if err != nil {
+			return err
+		}
+		if inode != 0 {
+			ports[inode] = strconv.FormatUint(port, 10) + "/" + proto
+		}
+	}
+	return nil
+}
+
+// parseTasks counts the entries in the task directory dir.
+func (l *lister) parseTasks(p *process, dir string) error {
+	f, err := os.Open(dir)
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+		// A thread (with -threads) has no task directory of its own.
+		// (If the process exited, we'll find out when reading its
+		// other files.)
+		p.ntasks = -1
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p.ntasks, l.buf, err = direntCount(f, l.buf)
+	return err
+}
+
+func (l *lister) parseMaps(p *process, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrPermission) {
+		p.nmaps = -1
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p.nmaps, err = l.countLines(f)
+	if errors.Is(err, os.ErrPermission) {
+		p.nmaps = -1
+		return nil
+	}
+	return err
+}
+
+// countLines counts the lines in f. Rather than reading the whole file into
+// memory, it reads it a chunk at a time using l.buf as scratch space.
+func (l *lister) countLines(f *os.File) (int64, error) {
+	l.buf = l.buf[:cap(l.buf)]
+	if len(l.buf) < blockSize {
+		l.buf = make([]byte, blockSize)
+	}
+	var n int64
+	for {
+		m, err := f.Read(l.buf)
+		n += int64(bytes.Count(l.buf[:m], []byte{'\n'}))
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readAll reads the entire contents of f into l.buf, usually with a single
+// ReadAt call. If the file doesn't fit, l.buf is grown (and kept at the new
+// size for later calls). The returned slice aliases l.buf, so it is only
+// valid until the next use of l.buf.
+func (l *lister) readAll(f *os.File) ([]byte, error) {
+	l.buf = l.buf[:cap(l.buf)]
+	if len(l.buf) < blockSize {
+		l.buf = make([]byte, blockSize)
+	}
+	var n int
+	for {
+		m, err := f.ReadAt(l.buf[n:], int64(n))
+		n += m
+		if err == io.EOF {
+			return l.buf[:n], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The buffer filled up, so there may be more to read.
+		b := make([]byte, 2*len(l.buf))
+		copy(b, l.buf[:n])
+		l.buf = b
+	}
+}
+
+func parseIntb(b []byte) (int, error) {
+	return strconv.Atoi(unsafeString(b))
+}
+
+func parseInt32(s string) (int32, error) {
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int32(n), nil
+}
+
+func parseInt32b(b []byte) (int32, error) {
+	return parseInt32(unsafeString(b))
+}
+
+func parseInt64b(b []byte) (int64, error) {
+	return strconv.ParseInt(unsafeString(b), 10, 64)
+}
+
+func parseUint64b(b []byte) (uint64, error) {
+	return strconv.ParseUint(unsafeString(b), 10, 64)
+}
+
+func unsafeString(b []byte) string {
+	var s string
+	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
+	sh.Data = (*reflect.SliceHeader)(unsafe.Pointer(&b)).Data
+	sh.Len = len(b)
+	return s
+}
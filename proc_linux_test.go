@@ -0,0 +1,768 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+func TestListerParseStat(t *testing.T) {
+	dir := t.TempDir()
+	const contents = `1860 (panel-6-indicat) S 1837 1689 1689 0 -1 4194304 2673 34 2 0 77 38 5 7 20 0 3 0 1971 440897536 6029 18446744073709551615 94731670310912 94731670333832 140730895617600 0 0 0 0 4096 0 0 0 0 17 0 0 0 0 0 0 94731672435056 94731672436756 94731700363264 140730895620536 140730895620840 140730895620840 140730895622086 0`
+	statPath := filepath.Join(dir, "stat")
+	if err := ioutil.WriteFile(statPath, []byte(contents), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	l := newLister(nil, 0)
+	l.clockTick = 10 * time.Millisecond
+	l.pageSize = 4096
+	l.uptime = 10 * time.Minute
+	p := new(process)
+	if err := l.parseStat(p, statPath); err != nil {
+		t.Fatalf("parseStat: %s", err)
+	}
+
+	want := &process{
+		name:     "panel-6-indicat",
+		state:    "S",
+		ppid:     1837,
+		pgid:     1689,
+		sid:      1689,
+		rss:      24694784,
+		uptime:   9*time.Minute + 40*time.Second + 290*time.Millisecond,
+		nthreads: 3,
+		utime:    770 * time.Millisecond,
+		stime:    380 * time.Millisecond,
+		cutime:   50 * time.Millisecond,
+		cstime:   70 * time.Millisecond,
+		cpuTime:  1270 * time.Millisecond,
+		selfCPU:  1150 * time.Millisecond,
+	}
+
+	if diff := cmp.Diff(p, want, cmp.AllowUnexported(process{})); diff != "" {
+		t.Errorf("parseStat gave incorrect output (-got,+want):\n%s", diff)
+	}
+}
+
+func TestListerParseStatLargeRSS(t *testing.T) {
+	p := parseTestStat(t, 0, map[int]string{24: "3000000000"})
+	if want := bytesize(3000000000 * 4096); p.rss != want {
+		t.Errorf("parseStat: got rss=%d; want %d", p.rss, want)
+	}
+}
+
+func TestListerParseStatLargeCPUTimes(t *testing.T) {
+	p := parseTestStat(t, 0, map[int]string{
+		14: "5000000000",
+		15: "4294967296",
+		16: "4294967297",
+		17: "4294967298",
+	})
+	want := struct{ utime, stime, cutime, cstime time.Duration }{
+		50000000 * time.Second,
+		42949672960 * time.Millisecond,
+		42949672970 * time.Millisecond,
+		42949672980 * time.Millisecond,
+	}
+	got := struct{ utime, stime, cutime, cstime time.Duration }{p.utime, p.stime, p.cutime, p.cstime}
+	if got != want {
+		t.Errorf("parseStat: got %+v; want %+v", got, want)
+	}
+}
+
+func TestListerParseStatLastCPU(t *testing.T) {
+	p := parseTestStat(t, colLastCPU, map[int]string{39: "5"})
+	if p.lastCPU != 5 {
+		t.Errorf("parseStat: got lastCPU=%d; want 5", p.lastCPU)
+	}
+	p = parseTestStat(t, 0, map[int]string{39: "5"})
+	if p.lastCPU != 0 {
+		t.Errorf("parseStat without colLastCPU: got lastCPU=%d; want 0", p.lastCPU)
+	}
+}
+
+func TestListerParseStatGuestTime(t *testing.T) {
+	p := parseTestStat(t, colGuestTime, map[int]string{43: "250"})
+	if want := 2500 * time.Millisecond; p.guestTime != want {
+		t.Errorf("parseStat: got guestTime=%s; want %s", p.guestTime, want)
+	}
+}
+
+func TestListerParseStatBlkioDelay(t *testing.T) {
+	p := parseTestStat(t, colBlkioDelay, map[int]string{42: "1234"})
+	if want := 12340 * time.Millisecond; p.blkioDelay != want {
+		t.Errorf("parseStat: got blkioDelay=%s; want %s", p.blkioDelay, want)
+	}
+}
+
+func TestListerParseStatRTPrio(t *testing.T) {
+	p := parseTestStat(t, colRTPrio, map[int]string{40: "50"})
+	if p.rtPrio != 50 {
+		t.Errorf("parseStat: got rtPrio=%d; want 50", p.rtPrio)
+	}
+}
+
+func TestListerParseStatShort(t *testing.T) {
+	// Older kernels report fewer fields. Here the line ends after field
+	// 38 (exit_signal), before the processor field that colLastCPU
+	// needs, so lastCPU is left unset.
+	fields := strings.Fields(testStat)[:38]
+	if n := lastStatField(colLastCPU); n <= len(fields) {
+		t.Fatalf("lastStatField(colLastCPU) = %d; want more than %d", n, len(fields))
+	}
+	p := parseTestStatLine(t, colLastCPU, strings.Join(fields, " ")+"\n")
+	if p.rss != 24694784 || p.lastCPU != 0 {
+		t.Errorf("parseStat: got rss=%d, lastCPU=%d; want 24694784, 0", p.rss, p.lastCPU)
+	}
+
+	// A line that stops before rss leaves it unset, too.
+	p = parseTestStatLine(t, colRSS, strings.Join(strings.Fields(testStat)[:22], " "))
+	if p.ppid != 1837 || p.nthreads != 3 || p.rss != 0 {
+		t.Errorf("parseStat: got ppid=%d, nthreads=%d, rss=%d; want 1837, 3, 0", p.ppid, p.nthreads, p.rss)
+	}
+}
+
+// testStat is a sample /proc/[pid]/stat line used as the basis of
+// parseTestStat.
+const testStat = `1860 (panel-6-indicat) S 1837 1689 1689 0 -1 4194304 2673 34 2 0 77 38 5 7 20 0 3 0 1971 440897536 6029 18446744073709551615 94731670310912 94731670333832 140730895617600 0 0 0 0 4096 0 0 0 0 17 0 0 0 0 0 0 94731672435056 94731672436756 94731700363264 140730895620536 140730895620840 140730895620840 140730895622086 0`
+
+// parseTestStat runs parseStat over testStat with the given (1-indexed)
+// fields replaced.
+func parseTestStat(t *testing.T, needCols column, fields map[int]string) *process {
+	t.Helper()
+	split := strings.Fields(testStat)
+	for i, v := range fields {
+		split[i-1] = v
+	}
+	return parseTestStatLine(t, needCols, strings.Join(split, " "))
+}
+
+// parseTestStatLine runs parseStat over the given stat line.
+func parseTestStatLine(t *testing.T, needCols column, stat string) *process {
+	t.Helper()
+	statPath := filepath.Join(t.TempDir(), "stat")
+	if err := ioutil.WriteFile(statPath, []byte(stat), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := newLister(nil, needCols)
+	l.clockTick = 10 * time.Millisecond
+	l.pageSize = 4096
+	l.uptime = 10 * time.Minute
+	p := new(process)
+	if err := l.parseStat(p, statPath); err != nil {
+		t.Fatalf("parseStat: %s", err)
+	}
+	return p
+}
+
+func TestListerParseStatus(t *testing.T) {
+	const contents = `Name:	worker
+Umask:	0027
+State:	S (sleeping)
+Tgid:	1860
+Ngid:	0
+Pid:	1862
+PPid:	1837
+TracerPid:	0
+Uid:	1000	1000	1000	1000
+Gid:	1000	1000	1000	1000
+FDSize:	64
+Groups:	4 24 27 1000 
+NStgid:	1860	5
+NSpid:	1862	7
+VmRSS:	    1296 kB
+Threads:	3
+SigQ:	0/23960
+SigPnd:	0000000000000000
+ShdPnd:	0000000000000000
+SigBlk:	0000000000010000
+SigIgn:	0000000000001000
+SigCgt:	0000000180004002
+CapInh:	0000000000000000
+CapPrm:	0000000000000000
+CapEff:	0000000000000000
+CapBnd:	000001ffffffffff
+CapAmb:	0000000000000000
+NoNewPrivs:	1
+Seccomp:	2
+Seccomp_filters:	1
+`
+	statusPath := filepath.Join(t.TempDir(), "status")
+	if err := ioutil.WriteFile(statusPath, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := newLister(nil, 0)
+	l.users = map[uint32]string{1000: "alice"}
+	p := new(process)
+	if err := l.parseStatus(p, statusPath); err != nil {
+		t.Fatalf("parseStatus: %s", err)
+	}
+	want := &process{
+		tgid:    1860,
+		groups:  "4,24,27,1000",
+		ruid:    "alice",
+		euid:    "alice",
+		seccomp: "filter",
+		caps:    "none",
+		umask:   "0027",
+		sigBlk:  "CHLD",
+		sigIgn:  "PIPE",
+		sigCgt:  "INT,TERM,32,33",
+		nsPID:   7,
+	}
+	if diff := cmp.Diff(p, want, cmp.AllowUnexported(process{})); diff != "" {
+		t.Errorf("parseStatus gave incorrect output (-got,+want):\n%s", diff)
+	}
+}
+
+func TestListerParseStatm(t *testing.T) {
+	dir := t.TempDir()
+	writeProcFile(t, dir, "statm", "1234 567 300 5 0 250 0\n")
+	l := newLister(nil, 0)
+	l.pageSize = 4096
+	p := new(process)
+	if err := l.parseStatm(p, filepath.Join(dir, "statm")); err != nil {
+		t.Fatalf("parseStatm: %s", err)
+	}
+	want := &process{
+		text: 5 * 4096,
+		data: 250 * 4096,
+	}
+	if diff := cmp.Diff(p, want, cmp.AllowUnexported(process{})); diff != "" {
+		t.Errorf("parseStatm gave incorrect output (-got,+want):\n%s", diff)
+	}
+}
+
+func TestListerParseCgroup(t *testing.T) {
+	dir := t.TempDir()
+	l := newLister(nil, 0)
+	const id = "4f1b1fa2ab41c1ae6e31b8a2cc5e34d1c2b6b2a87eb8e0d2f1d1ffbd4c3a9e77"
+	for _, tt := range []struct {
+		contents string
+		want     string
+	}{
+		{"0::/\n", ""},
+		{"0::/user.slice/user-1000.slice/session-2.scope\n", ""},
+		{"12:memory:/docker/" + id + "\n11:cpu:/docker/" + id + "\n", "4f1b1fa2ab41"},
+		{"0::/system.slice/docker-" + id + ".scope\n", "4f1b1fa2ab41"},
+		{"0::/kubepods.slice/kubepods-pod1.slice/cri-containerd-" + id + ".scope", "4f1b1fa2ab41"},
+		{"0::/kubepods/burstable/pod1/" + id + "\n", "4f1b1fa2ab41"},
+	} {
+		writeProcFile(t, dir, "cgroup", tt.contents)
+		p := new(process)
+		if err := l.parseCgroup(p, filepath.Join(dir, "cgroup")); err != nil {
+			t.Fatalf("parseCgroup(%q): %s", tt.contents, err)
+		}
+		if p.container != tt.want {
+			t.Errorf("parseCgroup(%q): got %q; want %q", tt.contents, p.container, tt.want)
+		}
+	}
+}
+
+func TestListerReadNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	for name, target := range map[string]string{
+		"pid": "pid:[4026531836]",
+		"net": "net:[4026532281]",
+		"mnt": "mnt:[4026531841]",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := newLister(nil, colNetNS|colMntNS)
+	p := new(process)
+	if err := l.readNamespaces(p, dir); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{p.pidNS, p.netNS, p.mntNS}
+	want := []string{"", "4026532281", "4026531841"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("readNamespaces (-got, +want):\n%s", diff)
+	}
+
+	// A zombie's ns links are missing.
+	p = new(process)
+	if err := l.readNamespaces(p, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if p.netNS != "?" || p.mntNS != "?" {
+		t.Errorf("readNamespaces of zombie: got netns=%q, mntns=%q; want ?, ?", p.netNS, p.mntNS)
+	}
+}
+
+func TestListerParseFDLinks(t *testing.T) {
+	dir := t.TempDir()
+	for fd, target := range []string{
+		"/dev/null",
+		"socket:[78910]",
+		"pipe:[1234]",
+		"socket:[78911]",
+		"/tmp/socket:[1]",
+		"anon_inode:[eventfd]",
+		"/home/alice/log.txt (deleted)",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, strconv.Itoa(fd))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := newLister(nil, 0)
+	p := new(process)
+	if err := l.parseFDLinks(p, dir); err != nil {
+		t.Fatal(err)
+	}
+	if p.nsockets != 2 || p.nfiles != 3 {
+		t.Errorf("got nsockets=%d, nfiles=%d; want 2, 3", p.nsockets, p.nfiles)
+	}
+}
+
+func TestListerParseTasks(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "task")
+	for _, tid := range []string{"100", "101", "105"} {
+		if err := os.MkdirAll(filepath.Join(dir, tid), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := newLister(nil, 0)
+	p := new(process)
+	if err := l.parseTasks(p, dir); err != nil {
+		t.Fatal(err)
+	}
+	if p.ntasks != 3 {
+		t.Errorf("got ntasks=%d; want 3", p.ntasks)
+	}
+	if err := l.parseTasks(p, filepath.Join(dir, "100", "task")); err != nil {
+		t.Fatal(err)
+	}
+	if p.ntasks != -1 {
+		t.Errorf("with no task dir: got ntasks=%d; want -1", p.ntasks)
+	}
+}
+
+func TestListerParseLoginUID(t *testing.T) {
+	dir := t.TempDir()
+	l := newLister(nil, 0)
+	l.users = map[uint32]string{1000: "alice"}
+	for _, tt := range []struct {
+		contents string
+		want     string
+	}{
+		{"1000", "alice"},
+		{"54321\n", "54321"},
+		{"4294967295", "?"},
+		{"", "?"}, // no loginuid file
+	} {
+		path := filepath.Join(dir, "loginuid")
+		os.Remove(path)
+		if tt.contents != "" {
+			writeProcFile(t, dir, "loginuid", tt.contents)
+		}
+		p := new(process)
+		if err := l.parseLoginUID(p, path); err != nil {
+			t.Fatalf("parseLoginUID(%q): %s", tt.contents, err)
+		}
+		if p.loginUID != tt.want {
+			t.Errorf("parseLoginUID(%q): got %q; want %q", tt.contents, p.loginUID, tt.want)
+		}
+	}
+}
+
+func TestListerParseSmapsRollup(t *testing.T) {
+	const contents = `55c3a4a4d000-7ffe4d1fe000 ---p 00000000 00:00 0                          [rollup]
+Rss:                5664 kB
+Pss:                1306 kB
+Pss_Anon:            576 kB
+Pss_File:            730 kB
+Pss_Shmem:             0 kB
+Shared_Clean:       4868 kB
+Shared_Dirty:          0 kB
+Private_Clean:       220 kB
+Private_Dirty:       576 kB
+Referenced:         5664 kB
+Anonymous:           576 kB
+Swap:                 12 kB
+SwapPss:              12 kB
+Locked:                0 kB
+`
+	path := filepath.Join(t.TempDir(), "smaps_rollup")
+	if err := ioutil.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := newLister(nil, smapsCols)
+	p := new(process)
+	if err := l.parseSmapsRollup(p, path); err != nil {
+		t.Fatalf("parseSmapsRollup: %s", err)
+	}
+	want := &process{
+		pss:  1306 * 1024,
+		uss:  796 * 1024,
+		swap: 12 * 1024,
+	}
+	if diff := cmp.Diff(p, want, cmp.AllowUnexported(process{})); diff != "" {
+		t.Errorf("parseSmapsRollup gave incorrect output (-got,+want):\n%s", diff)
+	}
+
+	// On kernels without smaps_rollup, the values are unknown.
+	p = new(process)
+	if err := l.parseSmapsRollup(p, filepath.Join(t.TempDir(), "smaps_rollup")); err != nil {
+		t.Fatalf("parseSmapsRollup of missing file: %s", err)
+	}
+	if p.pss != -1 || p.uss != -1 || p.swap != -1 {
+		t.Errorf("parseSmapsRollup of missing file: got pss=%d, uss=%d, swap=%d; want -1", p.pss, p.uss, p.swap)
+	}
+	// If the process directory is gone, the process exited.
+	p = new(process)
+	err := l.parseSmapsRollup(p, filepath.Join(t.TempDir(), "123", "smaps_rollup"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("parseSmapsRollup of exited process: got err=%v; want ErrNotExist", err)
+	}
+}
+
+func TestListerCountLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maps")
+	line := "7f2d2c000000-7f2d2c021000 rw-p 00000000 00:00 0\n"
+	if err := ioutil.WriteFile(path, []byte(strings.Repeat(line, 1000)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := newLister(nil, 0)
+	for i := 0; i < 2; i++ {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := l.countLines(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("countLines: %s", err)
+		}
+		if n != 1000 {
+			t.Fatalf("countLines: got %d; want 1000", n)
+		}
+	}
+}
+
+func TestListerList(t *testing.T) {
+	root := t.TempDir()
+	writeProcFile(t, root, "uptime", "600.00 1200.00\n")
+	writeProcFile(t, root, "1/stat", `1 (init) S 0 1 1 0 -1 4194560 0 0 0 0 5 10 0 0 20 0 1 0 2 1000 100 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0`)
+	writeProcFile(t, root, "1/cmdline", "/sbin/init\x00splash\x00")
+	writeProcFile(t, root, "20/stat", `20 (sh) S 1 20 20 0 -1 4194560 0 0 0 0 1 2 0 0 20 0 1 0 300 1000 50 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0`)
+	writeProcFile(t, root, "20/cmdline", "sh\x00-c\x00sleep 10\x00")
+	writeProcFile(t, root, "sys/kernel", "")
+
+	l := newLister(new(filter), colPID|colPPID|colName|colCmdline|colPName|colArg0)
+	l.procRoot = root
+	l.clockTick = 10 * time.Millisecond
+	ps, err := l.list(context.Background())
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	type result struct {
+		pid     int
+		ppid    int
+		name    string
+		cmdline string
+		pname   string
+		arg0    string
+	}
+	var got []result
+	for _, p := range ps {
+		got = append(got, result{p.pid, p.ppid, p.name, p.cmdline, p.pname, p.arg0})
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].pid < got[j].pid })
+	want := []result{
+		{1, 0, "init", "/sbin/init splash", "", "/sbin/init"},
+		{20, 1, "sh", "sh -c sleep 10", "init", "sh"},
+	}
+	if diff := cmp.Diff(got, want, cmp.AllowUnexported(result{})); diff != "" {
+		t.Errorf("list gave incorrect output (-got,+want):\n%s", diff)
+	}
+}
+
+func TestListerListProcRootSyscallCols(t *testing.T) {
+	// The pids in another /proc can't be passed to system calls, so the
+	// sched and affinity columns are unknown.
+	root := t.TempDir()
+	writeProcFile(t, root, "uptime", "600.00 1200.00\n")
+	writeProcFile(t, root, "1/stat", `1 (init) S 0 1 1 0 -1 4194560 0 0 0 0 5 10 0 0 20 0 1 0 2 1000 100 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0`)
+	l := newLister(new(filter), colPID|colSchedPolicy|colAffinity)
+	l.procRoot = root
+	ps, err := l.list(context.Background())
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(ps) != 1 {
+		t.Fatalf("list: got %d processes; want 1", len(ps))
+	}
+	if ps[0].schedPolicy != "?" || ps[0].affinity != "?" {
+		t.Errorf("got sched=%q, affinity=%q; want ?, ?", ps[0].schedPolicy, ps[0].affinity)
+	}
+}
+
+func TestListerReadAll(t *testing.T) {
+	dir := t.TempDir()
+	l := newLister(nil, 0)
+	for _, size := range []int{0, 10, blockSize - 1, blockSize, blockSize + 1, 5*blockSize + 3} {
+		contents := strings.Repeat("x", size)
+		writeProcFile(t, dir, "f", contents)
+		f, err := os.Open(filepath.Join(dir, "f"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := l.readAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("readAll (size %d): %s", size, err)
+		}
+		if string(b) != contents {
+			t.Errorf("readAll (size %d): got %d bytes", size, len(b))
+		}
+	}
+}
+
+func BenchmarkListerReadAll(b *testing.B) {
+	dir := b.TempDir()
+	writeProcFile(b, dir, "status", strings.Repeat("Key:\tvalue\n", 100))
+	path := filepath.Join(dir, "status")
+	l := newLister(nil, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := l.readAll(f); err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+	}
+}
+
+// BenchmarkList measures list over a synthetic /proc with many processes
+// that each have a handful of open files.
+func BenchmarkList(b *testing.B) {
+	const (
+		nprocs = 500
+		nfds   = 20
+	)
+	root := b.TempDir()
+	writeProcFile(b, root, "uptime", "600.00 1200.00\n")
+	for pid := 1; pid <= nprocs; pid++ {
+		dir := strconv.Itoa(pid)
+		stat := fmt.Sprintf("%d (worker-%d) S 1 %[1]d %[1]d 0 -1 4194560 0 0 0 0 5 10 0 0 20 0 1 0 2 1000 100 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0", pid, pid)
+		writeProcFile(b, root, dir+"/stat", stat)
+		writeProcFile(b, root, dir+"/cmdline", fmt.Sprintf("/usr/bin/worker\x00-id\x00%d\x00", pid))
+		for fd := 0; fd < nfds; fd++ {
+			writeProcFile(b, root, fmt.Sprintf("%s/fd/%d", dir, fd), "")
+		}
+	}
+
+	l := newLister(new(filter), colPID|colPPID|colName|colRSS|colCPUTime|colNFDs|colCmdline)
+	l.procRoot = root
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ps, err := l.list(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(ps) != nprocs {
+			b.Fatalf("got %d processes; want %d", len(ps), nprocs)
+		}
+	}
+}
+
+func TestListerListCanceled(t *testing.T) {
+	root := t.TempDir()
+	writeProcFile(t, root, "uptime", "600.00 1200.00\n")
+	writeProcFile(t, root, "1/stat", `1 (init) S 0 1 1 0 -1 4194560 0 0 0 0 5 10 0 0 20 0 1 0 2 1000 100 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0`)
+
+	l := newLister(new(filter), colPID)
+	l.procRoot = root
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.list(ctx); err != context.Canceled {
+		t.Fatalf("list with canceled context: got err=%v; want %v", err, context.Canceled)
+	}
+}
+
+func TestListerListSkipsExited(t *testing.T) {
+	root := t.TempDir()
+	writeProcFile(t, root, "uptime", "600.00 1200.00\n")
+	writeProcFile(t, root, "1/stat", `1 (init) S 0 1 1 0 -1 4194560 0 0 0 0 5 10 0 0 20 0 1 0 2 1000 100 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0`)
+	writeProcFile(t, root, "1/cmdline", "/sbin/init\x00")
+	// Process 20 exited before its stat was read.
+	if err := os.Mkdir(filepath.Join(root, "20"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// Process 30 exited after its stat was read but before its cmdline.
+	writeProcFile(t, root, "30/stat", `30 (sh) S 1 30 30 0 -1 4194560 0 0 0 0 1 2 0 0 20 0 1 0 300 1000 50 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0`)
+
+	l := newLister(new(filter), colPID|colCmdline)
+	l.procRoot = root
+	ps, err := l.list(context.Background())
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(ps) != 1 || ps[0].pid != 1 {
+		t.Fatalf("list: got %d processes; want just pid 1", len(ps))
+	}
+}
+
+func TestListerListThreads(t *testing.T) {
+	root := t.TempDir()
+	writeProcFile(t, root, "uptime", "600.00 1200.00\n")
+	const stat = `%d (%s) S 1 20 20 0 -1 4194560 0 0 0 0 1 2 0 0 20 0 2 0 300 1000 50 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0`
+	writeProcFile(t, root, "20/stat", fmt.Sprintf(stat, 20, "server"))
+	writeProcFile(t, root, "20/task/20/stat", fmt.Sprintf(stat, 20, "server"))
+	writeProcFile(t, root, "20/task/21/stat", fmt.Sprintf(stat, 21, "worker"))
+
+	l := newLister(new(filter), colPID|colName)
+	l.procRoot = root
+	l.threads = true
+	ps, err := l.list(context.Background())
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	type result struct {
+		pid  int
+		tgid int
+		name string
+	}
+	var got []result
+	for _, p := range ps {
+		got = append(got, result{p.pid, p.tgid, p.name})
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].pid < got[j].pid })
+	want := []result{
+		{20, 20, "server"},
+		{21, 20, "worker"},
+	}
+	if diff := cmp.Diff(got, want, cmp.AllowUnexported(result{})); diff != "" {
+		t.Errorf("list gave incorrect output (-got,+want):\n%s", diff)
+	}
+}
+
+func writeProcFile(t testing.TB, root, name, contents string) {
+	t.Helper()
+	path := filepath.Join(root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormatCaps(t *testing.T) {
+	const all = 1<<41 - 1
+	for _, tt := range []struct {
+		caps uint64
+		want string
+	}{
+		{0, "none"},
+		{all, "all"},
+		{1<<63 | all, "all"},
+		{1 << 10, "cap_net_bind_service"},
+		{1<<10 | 1<<21, "cap_net_bind_service,cap_sys_admin"},
+		{1<<0 | 1<<50, "cap_chown,cap_50"},
+	} {
+		if got := formatCaps(tt.caps, all); got != tt.want {
+			t.Errorf("formatCaps(%#x): got %q; want %q", tt.caps, got, tt.want)
+		}
+	}
+}
+
+func TestFormatCPUList(t *testing.T) {
+	for _, tt := range []struct {
+		cpus []int
+		want string
+	}{
+		{nil, ""},
+		{[]int{0}, "0"},
+		{[]int{0, 1, 2, 3}, "0-3"},
+		{[]int{0, 1, 2, 3, 8}, "0-3,8"},
+		{[]int{1, 3, 5, 6}, "1,3,5-6"},
+		{[]int{63, 64, 65, 1023}, "63-65,1023"},
+	} {
+		var set unix.CPUSet
+		for _, cpu := range tt.cpus {
+			set.Set(cpu)
+		}
+		if got := formatCPUList(&set); got != tt.want {
+			t.Errorf("formatCPUList(%v): got %q; want %q", tt.cpus, got, tt.want)
+		}
+	}
+}
+
+func TestParseNetTable(t *testing.T) {
+	const tcp = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:BC8F 00000000:0000 0A 00000000:00000000 00:00000000 00000000 65534        0 956 1 00000000de61c083 100 0 0 10 0
+   1: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 662 1 00000000bfc886bf 100 0 0 10 0
+   2: 0100007F:1F90 0100007F:D2A4 01 00000000:00000000 00:00000000 00000000  1000        0 663 1 00000000bfc886bf 20 4 30 10 -1
+`
+	const tcp6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:0016 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 17 1 0000000000000000 100 0 0 10 0
+`
+	const udp = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 3500007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 3071 2 0000000000000000 0
+  124: 0F02000A:A3C1 08080808:0035 01 00000000:00000000 00:00000000 00000000  1000        0 3072 2 0000000000000000 0
+`
+	ports := make(map[uint64]string)
+	for _, tt := range []struct {
+		contents string
+		proto    string
+		listen   string
+	}{
+		{tcp, "tcp", "0A"},
+		{tcp6, "tcp", "0A"},
+		{udp, "udp", "07"},
+	} {
+		if err := parseNetTable([]byte(tt.contents), tt.proto, tt.listen, ports); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[uint64]string{
+		956:  "48271/tcp",
+		662:  "8080/tcp",
+		17:   "22/tcp",
+		3071: "53/udp",
+	}
+	if diff := cmp.Diff(ports, want); diff != "" {
+		t.Errorf("parseNetTable (-got, +want):\n%s", diff)
+	}
+}
+
+func TestFormatPorts(t *testing.T) {
+	got := formatPorts([]string{"8080/tcp", "53/udp", "22/tcp", "8080/tcp", "53/tcp"})
+	if want := "22/tcp,53/tcp,53/udp,8080/tcp"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got := formatPorts(nil); got != "" {
+		t.Errorf("formatPorts(nil): got %q; want empty", got)
+	}
+}
+
+func TestListerSelfRSS(t *testing.T) {
+	l := newLister(nil, 0)
+	rss, err := l.selfRSS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rss <= 0 {
+		t.Errorf("got rss %d; want > 0", rss)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build (darwin || freebsd) && !cgo
+// +build darwin freebsd
+// +build !cgo
+
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+)
+
+// On macOS and FreeBSD, lp reads processes using cgo (libproc and the
+// kinfo_proc struct). Without cgo, it builds but can only report that.
+
+// supportedCols are the columns that can be displayed on this OS. All of
+// them pass this check so that the error from loadAll is the one shown.
+const supportedCols = numCols - 1
+
+var errNoCgo = errors.New("lp on " + runtime.GOOS + " requires cgo (build with CGO_ENABLED=1)")
+
+func newLister(f *filter, needCols column) *lister {
+	return &lister{
+		procRoot: "/proc",
+		needCols: needCols,
+		filter:   f,
+	}
+}
+
+func (l *lister) loadAll(ctx context.Context) ([]*process, error) {
+	return nil, errNoCgo
+}
+
+func (l *lister) selfRSS() (bytesize, error) {
+	return 0, errNoCgo
+}